@@ -0,0 +1,66 @@
+// Command gtfsimport loads a GTFS static feed (zip) into the database.
+//
+//	DATABASE_DSN=postgres://... go run ./cmd/gtfsimport feed.zip
+//	go run ./cmd/gtfsimport -dry-run feed.zip
+//
+// The feed is validated first; if any row is invalid every problem is printed
+// as file:line: message and nothing is written.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	db "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/gtfs"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "validate the feed without importing it")
+	timeout := flag.Duration("timeout", 10*time.Minute, "maximum time for the import")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: gtfsimport [-dry-run] [-timeout d] feed.zip\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	feed, err := gtfs.ParseFile(flag.Arg(0))
+	var verrs gtfs.ValidationErrors
+	if errors.As(err, &verrs) {
+		for _, e := range verrs {
+			fmt.Fprintln(os.Stderr, e.Error())
+		}
+		log.Fatalf("feed has %d validation errors, nothing imported", len(verrs))
+	}
+	if err != nil {
+		log.Fatalf("read feed: %v", err)
+	}
+	log.Printf("feed ok: %d agencies, %d routes, %d stops, %d trips, %d stop times, %d shapes, %d services",
+		len(feed.Agencies), len(feed.Routes), len(feed.Stops), len(feed.Trips), len(feed.StopTimes), len(feed.Shapes), len(feed.Calendar))
+	if *dryRun {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := db.Connect(ctx, os.Getenv("DATABASE_DSN")); err != nil {
+		log.Fatalf("db connect: %v", err)
+	}
+	defer db.Close()
+
+	st, err := db.ImportGTFS(ctx, feed)
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	log.Printf("imported %d routes, %d route stops, %d trips, %d stop times, %d shapes, %d services; removed %d routes, %d stops, %d trips no longer in the feed",
+		st.Routes, st.Stops, st.Trips, st.StopTimes, st.Shapes, st.Services, st.RemovedRoutes, st.RemovedStops, st.RemovedTrips)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dlqStream = "stream:positions:dlq"
+	// errorsKey remembers the last processing error per pending message so the
+	// reason survives until the entry is dead-lettered, whichever consumer does it.
+	errorsKey = "stream:positions:errors"
+)
+
+// reclaimer periodically takes over pending entries that have been idle too
+// long (e.g. from a crashed consumer or an earlier failed attempt), retries
+// them, and dead-letters those delivered maxDeliveries times.
+type reclaimer struct {
+	r             *redisclient.Client
+	stream        string
+	group         string
+	consumer      string
+	minIdle       time.Duration
+	maxDeliveries int64
+}
+
+// recordFailure stores the reason a message failed; the entry stays pending.
+func (rc *reclaimer) recordFailure(ctx context.Context, id string, err error) {
+	_ = rc.r.RDB().HSet(ctx, errorsKey, id, err.Error()).Err()
+}
+
+// ack acknowledges processed messages and forgets any earlier failures.
+func (rc *reclaimer) ack(ctx context.Context, ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := rc.r.RDB().XAck(ctx, rc.stream, rc.group, ids...).Err(); err != nil {
+		log.Printf("xack failed: %v", err)
+		return
+	}
+	_ = rc.r.RDB().HDel(ctx, errorsKey, ids...).Err()
+}
+
+// run claims every idle pending entry in batches and hands the retryable ones
+// to process, which returns the IDs it stored and the errors of the rest;
+// entries past maxDeliveries go to the DLQ instead.
+func (rc *reclaimer) run(ctx context.Context, process func([]redis.XMessage) ([]string, map[string]error)) {
+	start := "0-0"
+	for {
+		msgs, next, err := rc.r.RDB().XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   rc.stream,
+			Group:    rc.group,
+			Consumer: rc.consumer,
+			MinIdle:  rc.minIdle,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			log.Printf("xautoclaim error: %v", err)
+			return
+		}
+		if len(msgs) > 0 {
+			counts := rc.deliveryCounts(ctx, msgs)
+			retry := make([]redis.XMessage, 0, len(msgs))
+			for _, msg := range msgs {
+				if counts[msg.ID] > rc.maxDeliveries {
+					rc.deadLetter(ctx, msg, counts[msg.ID])
+					continue
+				}
+				retry = append(retry, msg)
+			}
+			if len(retry) > 0 {
+				done, failed := process(retry)
+				for id, err := range failed {
+					log.Printf("reclaimed process err: %v, msg: %v (delivery %d)", err, id, counts[id])
+					rc.recordFailure(ctx, id, err)
+				}
+				rc.ack(ctx, done...)
+			}
+		}
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
+
+// deliveryCounts looks up how often each claimed message has been delivered.
+func (rc *reclaimer) deliveryCounts(ctx context.Context, msgs []redis.XMessage) map[string]int64 {
+	pending, err := rc.r.RDB().XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   rc.stream,
+		Group:    rc.group,
+		Start:    msgs[0].ID,
+		End:      msgs[len(msgs)-1].ID,
+		Count:    int64(len(msgs)),
+		Consumer: rc.consumer,
+	}).Result()
+	counts := make(map[string]int64, len(msgs))
+	if err != nil {
+		log.Printf("xpending error: %v", err)
+		return counts
+	}
+	for _, p := range pending {
+		counts[p.ID] = p.RetryCount
+	}
+	return counts
+}
+
+// deadLetter copies a poison message to the DLQ with its failure reason and
+// acknowledges the original so it leaves the pending entries list.
+func (rc *reclaimer) deadLetter(ctx context.Context, msg redis.XMessage, deliveries int64) {
+	reason, err := rc.r.RDB().HGet(ctx, errorsKey, msg.ID).Result()
+	if err != nil {
+		reason = "unknown"
+	}
+	values := make(map[string]interface{}, len(msg.Values)+5)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["dlqOriginalId"] = msg.ID
+	values["dlqError"] = reason
+	values["dlqDeliveries"] = strconv.FormatInt(deliveries, 10)
+	values["dlqFailedAt"] = time.Now().Unix()
+	values["dlqConsumer"] = rc.consumer
+	if _, err := rc.r.XAdd(ctx, dlqStream, values); err != nil {
+		log.Printf("dlq xadd failed: %v, msg: %v", err, msg.ID)
+		return
+	}
+	log.Printf("dead-lettered msg %v after %d deliveries: %s", msg.ID, deliveries, reason)
+	rc.ack(ctx, msg.ID)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/geofence"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// geofenceEventsChannel carries geofence events to the websocket broker.
+	geofenceEventsChannel = "events:geofences"
+	// geofenceStateTTL drops the fence state of buses that stopped reporting.
+	geofenceStateTTL = 24 * time.Hour
+)
+
+// geofenceMonitor turns fixes into enter, exit and dwell events for the
+// active geofences. A bus enters with its first fix inside a fence and exits
+// with its first fix outside it; a dwell event is raised once per visit when
+// the bus has been inside for the fence's dwell time.
+//
+// Fences are held in an in-memory index, reloaded when geofence.VersionKey
+// changes and at least every refreshEvery. The fences each bus is inside are
+// kept in vehicle:<id>:geofences, so whichever worker reads the next fix
+// continues the visit. As for stops, the state is only replaced if no other
+// worker changed it meanwhile, and fixes not newer than the last one handled
+// are skipped. Events that fail to insert are kept in the state and retried,
+// also as for stops. A fence that was deleted or deactivated during a visit
+// is forgotten without an exit event.
+type geofenceMonitor struct {
+	r            *redisclient.Client
+	refreshEvery time.Duration
+
+	index    *geofence.Index
+	version  string
+	loadedAt time.Time
+}
+
+// fenceVisit is one fence a bus is inside.
+type fenceVisit struct {
+	EnteredAt int64
+	Dwelled   bool
+}
+
+// fenceState is vehicle:<id>:geofences: the ts of the last fix handled and a
+// field per fence the bus is inside, holding "<enteredAt>" or
+// "<enteredAt>:dwell", plus any pending events (see updateStates).
+type fenceState struct {
+	Ts     int64
+	Inside map[string]*fenceVisit
+}
+
+func (s *fenceState) values() map[string]interface{} {
+	m := map[string]interface{}{"ts": s.Ts}
+	for id, v := range s.Inside {
+		val := strconv.FormatInt(v.EnteredAt, 10)
+		if v.Dwelled {
+			val += ":dwell"
+		}
+		m[id] = val
+	}
+	return m
+}
+
+func parseFenceState(h map[string]string) *fenceState {
+	s := &fenceState{Inside: make(map[string]*fenceVisit)}
+	for k, v := range h {
+		if k == "ts" {
+			s.Ts, _ = strconv.ParseInt(v, 10, 64)
+			continue
+		}
+		if k == "pending" {
+			continue
+		}
+		enteredAt, dwell, _ := strings.Cut(v, ":")
+		visit := &fenceVisit{Dwelled: dwell == "dwell"}
+		visit.EnteredAt, _ = strconv.ParseInt(enteredAt, 10, 64)
+		s.Inside[k] = visit
+	}
+	return s
+}
+
+// refresh reloads the index when it is missing, outdated or older than
+// refreshEvery. The version is read first, so a change made during the load
+// triggers another one.
+func (m *geofenceMonitor) refresh(ctx context.Context) error {
+	version, err := m.r.RDB().Get(ctx, geofence.VersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if m.index != nil && version == m.version && time.Since(m.loadedAt) < m.refreshEvery {
+		return nil
+	}
+	fences, err := db.ListActiveGeofences(ctx)
+	if err != nil {
+		return err
+	}
+	if m.index == nil || version != m.version {
+		log.Printf("loaded %d active geofences (version %q)", len(fences), version)
+	}
+	m.index, m.version, m.loadedAt = geofence.NewIndex(fences), version, time.Now()
+	return nil
+}
+
+// detect processes committed fixes. A failed refresh falls back to the
+// index already loaded.
+func (m *geofenceMonitor) detect(ctx context.Context, rows []db.PositionRow) error {
+	if err := m.refresh(ctx); err != nil {
+		if m.index == nil {
+			return err
+		}
+		log.Printf("geofence refresh failed, using the loaded index: %v", err)
+	}
+	if m.index.Len() == 0 || len(rows) == 0 {
+		return nil
+	}
+	fixes := append([]db.PositionRow(nil), rows...)
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].Ts < fixes[j].Ts })
+
+	busIDs, byBus := groupByBus(fixes)
+	claimed := make(map[string][]pendingGeofenceEvent)
+	err := updateStates(ctx, m.r, geofenceStateKey, busIDs, geofenceStateTTL, func(busID string, h map[string]string) (map[string]interface{}, func()) {
+		st := parseFenceState(h)
+		var evs []pendingGeofenceEvent
+		loadPending(h, &evs)
+		emit := func(f *db.PositionRow, fence *geofence.Fence, kind string, dwell *int) {
+			ev := db.GeofenceEvent{GeofenceID: fence.ID, BusID: f.BusID, Event: kind, Ts: time.Unix(f.Ts, 0), Lat: f.Lat, Lon: f.Lon, DwellSeconds: dwell}
+			evs = append(evs, pendingGeofenceEvent{Event: ev, Payload: geofenceEventPayload(&ev, fence, f)})
+		}
+		advanced := false
+		for _, i := range byBus[busID] {
+			f := &fixes[i]
+			if f.Ts <= st.Ts {
+				continue
+			}
+			inside := make(map[string]bool)
+			for _, fence := range m.index.Containing(f.Lat, f.Lon) {
+				inside[fence.ID] = true
+				visit, ok := st.Inside[fence.ID]
+				if !ok {
+					emit(f, fence, db.GeofenceEnter, nil)
+					st.Inside[fence.ID] = &fenceVisit{EnteredAt: f.Ts}
+					continue
+				}
+				if dwell := f.Ts - visit.EnteredAt; fence.DwellAfter > 0 && !visit.Dwelled && dwell >= int64(fence.DwellAfter.Seconds()) {
+					d := int(dwell)
+					emit(f, fence, db.GeofenceDwell, &d)
+					visit.Dwelled = true
+				}
+			}
+			for id, visit := range st.Inside {
+				if inside[id] {
+					continue
+				}
+				if fence := m.index.Get(id); fence != nil {
+					d := int(f.Ts - visit.EnteredAt)
+					emit(f, fence, db.GeofenceExit, &d)
+				}
+				delete(st.Inside, id)
+			}
+			st.Ts = f.Ts
+			advanced = true
+		}
+		if !advanced && h["pending"] == "" {
+			return nil, nil
+		}
+		return st.values(), func() {
+			if len(evs) > 0 {
+				claimed[busID] = evs
+			}
+		}
+	})
+
+	// events of buses whose state was stored are kept even if others failed
+	if len(claimed) > 0 {
+		if serr := m.store(ctx, busIDs, claimed); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// pendingGeofenceEvent is a geofence event and its websocket payload, kept in
+// the bus's state while it waits to be stored.
+type pendingGeofenceEvent struct {
+	Event   db.GeofenceEvent
+	Payload string
+}
+
+// store inserts and publishes the events claimed from each bus's state. If
+// the insert fails they are put back into the state, as for stops.
+func (m *geofenceMonitor) store(ctx context.Context, busIDs []string, claimed map[string][]pendingGeofenceEvent) error {
+	var events []db.GeofenceEvent
+	var payloads []string
+	for _, id := range busIDs {
+		for _, p := range claimed[id] {
+			events, payloads = append(events, p.Event), append(payloads, p.Payload)
+		}
+	}
+	if err := db.InsertGeofenceEvents(ctx, events); err != nil {
+		pending := make(map[string]interface{}, len(claimed))
+		for id, evs := range claimed {
+			pending[id] = evs
+		}
+		if perr := savePending(ctx, m.r, geofenceStateKey, geofenceStateTTL, pending); perr != nil {
+			return fmt.Errorf("insert geofence events: %w; keeping them for retry: %v", err, perr)
+		}
+		return err
+	}
+	pipe := m.r.RDB().Pipeline()
+	for _, p := range payloads {
+		pipe.Publish(ctx, geofenceEventsChannel, p)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func geofenceStateKey(busID string) string { return "vehicle:" + busID + ":geofences" }
+
+// geofenceEventPayload is the websocket event for ev.
+func geofenceEventPayload(ev *db.GeofenceEvent, fence *geofence.Fence, f *db.PositionRow) string {
+	m := map[string]interface{}{
+		"type":       "geofence",
+		"event":      ev.Event,
+		"busId":      ev.BusID,
+		"geofenceId": ev.GeofenceID,
+		"name":       fence.Name,
+		"ts":         ev.Ts.Unix(),
+		"lat":        ev.Lat,
+		"lon":        ev.Lon,
+	}
+	if f.RouteID != nil {
+		m["routeId"] = *f.RouteID
+	}
+	if ev.DwellSeconds != nil {
+		m["dwellSeconds"] = *ev.DwellSeconds
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
@@ -40,6 +40,29 @@ func main() {
 		log.Printf("xgroup create: %v", err)
 	}
 
+	rc := &reclaimer{
+		r:             r,
+		stream:        stream,
+		group:         consumerGroup,
+		consumer:      consumerName,
+		minIdle:       envDuration("WORKER_RECLAIM_MIN_IDLE", time.Minute),
+		maxDeliveries: int64(envInt("WORKER_MAX_DELIVERIES", 5)),
+	}
+	reclaimInterval := envDuration("WORKER_RECLAIM_INTERVAL", 30*time.Second)
+	lastReclaim := time.Now()
+
+	pm := &partitionManager{
+		monthsAhead:     envInt("PARTITIONS_MONTHS_AHEAD", 3),
+		retentionMonths: envInt("PARTITIONS_RETENTION_MONTHS", 0),
+		mode:            envString("PARTITIONS_RETENTION_MODE", "detach"),
+	}
+	partitionInterval := envDuration("PARTITIONS_CHECK_INTERVAL", time.Hour)
+
+	stops := &stopDetector{r: r, radius: float64(envInt("STOP_RADIUS_METERS", 30))}
+	fences := &geofenceMonitor{r: r, refreshEvery: envDuration("GEOFENCES_REFRESH_INTERVAL", time.Minute)}
+	pm.run(ctx, time.Now())
+	lastPartitionCheck := time.Now()
+
 	// graceful shutdown
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
@@ -50,6 +73,16 @@ loop:
 			log.Println("shutting down")
 			break loop
 		default:
+			if time.Since(lastReclaim) >= reclaimInterval {
+				rc.run(ctx, func(msgs []redis.XMessage) ([]string, map[string]error) {
+					return processBatch(ctx, msgs, stops, fences)
+				})
+				lastReclaim = time.Now()
+			}
+			if time.Since(lastPartitionCheck) >= partitionInterval {
+				pm.run(ctx, time.Now())
+				lastPartitionCheck = time.Now()
+			}
 			// read with XREADGROUP
 			streams, err := r.RDB().XReadGroup(ctx, &redis.XReadGroupArgs{
 				Group:    consumerGroup,
@@ -65,42 +98,102 @@ loop:
 			}
 			// process
 			for _, s := range streams {
-				for _, msg := range s.Messages {
-					if err := processMessage(ctx, r, msg); err != nil {
-						log.Printf("process err: %v, msg: %v", err, msg.ID)
-						// do not ack; message remains pending for retry/dlq
-						continue
-					}
-					// ack
-					if err := r.RDB().XAck(ctx, stream, consumerGroup, msg.ID).Err(); err != nil {
-						log.Printf("xack failed: %v", err)
-					}
+				if len(s.Messages) == 0 {
+					continue
 				}
+				done, failed := processBatch(ctx, s.Messages, stops, fences)
+				for id, err := range failed {
+					log.Printf("process err: %v, msg: %v", err, id)
+					// do not ack; the reclaimer retries it once idle and dead-letters it after too many deliveries
+					rc.recordFailure(ctx, id, err)
+				}
+				rc.ack(ctx, done...)
 			}
 		}
 	}
 }
 
-func processMessage(ctx context.Context, r *redisclient.Client, msg redis.XMessage) error {
+// processBatch stores a read batch with a single multi-row insert and returns
+// the IDs that were committed. If the batch insert fails, rows are retried one
+// by one so a single bad row only fails itself. Live position events are
+// published at ingest; the worker only publishes the stop and geofence events
+// it derives from committed rows.
+func processBatch(ctx context.Context, msgs []redis.XMessage, stops *stopDetector, fences *geofenceMonitor) ([]string, map[string]error) {
+	failed := make(map[string]error)
+	rows := make([]db.PositionRow, 0, len(msgs))
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		row, err := parseMessage(msg)
+		if err != nil {
+			failed[msg.ID] = err
+			continue
+		}
+		rows = append(rows, row)
+		ids = append(ids, msg.ID)
+	}
+	if len(rows) == 0 {
+		return nil, failed
+	}
+
+	err := db.InsertPositions(ctx, rows)
+	if err == nil {
+		detectEvents(ctx, stops, fences, rows)
+		return ids, failed
+	}
+	log.Printf("batch insert of %d rows failed, falling back to per-row: %v", len(rows), err)
+
+	done := make([]string, 0, len(rows))
+	stored := make([]db.PositionRow, 0, len(rows))
+	for i, row := range rows {
+		if err := db.InsertPosition(ctx, row); err != nil {
+			failed[ids[i]] = err
+			continue
+		}
+		done = append(done, ids[i])
+		stored = append(stored, row)
+	}
+	detectEvents(ctx, stops, fences, stored)
+	return done, failed
+}
+
+// detectEvents runs stop and geofence detection on stored rows. Events that
+// fail to insert are retried with each bus's next fixes; other failures lose
+// the events, since the fixes are already committed and are not retried.
+func detectEvents(ctx context.Context, stops *stopDetector, fences *geofenceMonitor, rows []db.PositionRow) {
+	if err := stops.detect(ctx, rows); err != nil {
+		log.Printf("stop detection failed for %d rows: %v", len(rows), err)
+	}
+	if err := fences.detect(ctx, rows); err != nil {
+		log.Printf("geofence detection failed for %d rows: %v", len(rows), err)
+	}
+}
+
+func parseMessage(msg redis.XMessage) (db.PositionRow, error) {
 	// Extract fields safely
 	busId, ok := msg.Values["busId"].(string)
 	if !ok || busId == "" {
-		return fmt.Errorf("invalid busId")
+		return db.PositionRow{}, fmt.Errorf("invalid busId")
 	}
 	lat, _ := parseFloatFromInterface(msg.Values["lat"])
 	lon, _ := parseFloatFromInterface(msg.Values["lon"])
 	tsInt, _ := parseInt64FromInterface(msg.Values["ts"])
 	speed, _ := parseFloatFromInterface(msg.Values["speed"])
-
-	// Insert into Postgres positions table
-	if err := db.InsertPosition(ctx, busId, tsInt, lat, lon, speed, msg.Values); err != nil {
-		return err
+	heading, _ := parseFloatFromInterface(msg.Values["heading"])
+	// routeId is stamped at ingest from the bus registry; older entries lack it
+	var routeId *string
+	if s, ok := msg.Values["routeId"].(string); ok && s != "" {
+		routeId = &s
 	}
-	// publish to pubsub channel for websockets (optional; can use Redis.Publish)
-	_ = r.Publish(ctx, "vehicle:"+busId, map[string]interface{}{
-		"busId": busId, "lat": lat, "lon": lon, "ts": tsInt,
-	})
-	return nil
+	return db.PositionRow{
+		BusID:   busId,
+		RouteID: routeId,
+		Ts:      tsInt,
+		Lat:     lat,
+		Lon:     lon,
+		Speed:   speed,
+		Heading: heading,
+		Raw:     msg.Values,
+	}, nil
 }
 
 func parseFloatFromInterface(v interface{}) (float64, error) {
@@ -142,3 +235,28 @@ func parseInt64FromInterface(v interface{}) (int64, error) {
 		return 0, fmt.Errorf("unsupported type")
 	}
 }
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
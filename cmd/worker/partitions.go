@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	db "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+)
+
+// partitionManager keeps monthly positions partitions ahead of time and
+// retires those past the retention window.
+type partitionManager struct {
+	monthsAhead int
+	// retentionMonths is how many whole months before the current one are
+	// kept; 0 keeps everything.
+	retentionMonths int
+	// mode is "detach" (keep the table for archiving) or "drop".
+	mode string
+}
+
+func (pm *partitionManager) run(ctx context.Context, now time.Time) {
+	if err := db.EnsurePositionPartitions(ctx, now, pm.monthsAhead); err != nil {
+		log.Printf("partition create failed: %v", err)
+	}
+	if pm.retentionMonths <= 0 {
+		return
+	}
+
+	parts, err := db.ListPositionPartitions(ctx)
+	if err != nil {
+		log.Printf("partition list failed: %v", err)
+		return
+	}
+	cutoff := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -pm.retentionMonths, 0)
+	for _, p := range parts {
+		if p.To.After(cutoff) {
+			continue
+		}
+		if pm.mode == "drop" {
+			err = db.DropPositionPartition(ctx, p.Name)
+		} else {
+			err = db.DetachPositionPartition(ctx, p.Name)
+		}
+		if err != nil {
+			log.Printf("partition %s %s failed: %v", pm.mode, p.Name, err)
+			continue
+		}
+		log.Printf("partition %s: %s", pm.mode, p.Name)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	db "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// casAttempts bounds how often one bus's state update is retried after
+// another worker changed the state first.
+const casAttempts = 3
+
+// casStateScript replaces a per-bus state hash only while its ts and pending
+// fields still hold the values the caller read, so two workers handling fixes
+// of the same bus cannot both apply a transition from the same state. The new
+// hash has no pending field: the caller has claimed those events.
+//
+// KEYS[1] state hash; ARGV expected ts and pending ("" when unset), ttl ms,
+// then field/value pairs
+// returns 1 when stored, 0 when the state changed in between
+var casStateScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], 'ts') or ''
+local pending = redis.call('HGET', KEYS[1], 'pending') or ''
+if cur ~= ARGV[1] or pending ~= ARGV[2] then return 0 end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], unpack(ARGV, 4))
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// appendPendingScript appends a JSON array of events to the pending field of
+// a state hash, so the next update of the bus claims and retries them. It
+// does not compare ts: an update that read the hash before the append fails
+// its pending check and reloads.
+//
+// KEYS[1] state hash; ARGV JSON array, ttl ms
+var appendPendingScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], 'pending')
+local list = ARGV[1]
+if cur then list = string.sub(cur, 1, -2) .. ',' .. string.sub(ARGV[1], 2) end
+redis.call('HSET', KEYS[1], 'pending', list)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// stateStep computes the next state of a bus from the stored hash h. It
+// returns nil when nothing changes and nothing is pending, and otherwise the
+// new hash, which must carry ts, and a commit func run only once that hash is
+// stored. Events pending in h are claimed by storing it.
+type stateStep func(busID string, h map[string]string) (next map[string]interface{}, commit func())
+
+// updateStates runs step for every bus against the hash at key(busID) and
+// stores the results with casStateScript. Buses whose state changed
+// concurrently are reloaded and stepped again, up to casAttempts times.
+func updateStates(ctx context.Context, r *redisclient.Client, key func(string) string, busIDs []string, ttl time.Duration, step stateStep) error {
+	pending := busIDs
+	for attempt := 0; attempt < casAttempts && len(pending) > 0; attempt++ {
+		pipe := r.RDB().Pipeline()
+		reads := make([]*redis.MapStringStringCmd, len(pending))
+		for i, id := range pending {
+			reads[i] = pipe.HGetAll(ctx, key(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		type write struct {
+			busID  string
+			cmd    *redis.Cmd
+			commit func()
+		}
+		var writes []write
+		pipe = r.RDB().Pipeline()
+		for i, id := range pending {
+			h := reads[i].Val()
+			next, commit := step(id, h)
+			if next == nil {
+				continue
+			}
+			args := []interface{}{h["ts"], h["pending"], ttl.Milliseconds()}
+			for k, v := range next {
+				args = append(args, k, v)
+			}
+			// Eval rather than Run: EVALSHA cannot fall back to EVAL inside a pipeline
+			writes = append(writes, write{id, casStateScript.Eval(ctx, pipe, []string{key(id)}, args...), commit})
+		}
+		if len(writes) == 0 {
+			return nil
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		var lost []string
+		for _, w := range writes {
+			if n, _ := w.cmd.Int64(); n == 1 {
+				w.commit()
+			} else {
+				lost = append(lost, w.busID)
+			}
+		}
+		pending = lost
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("state of %d buses kept changing concurrently", len(pending))
+	}
+	return nil
+}
+
+// loadPending decodes the events pending in h into v, a pointer to a slice.
+// Undecodable events are logged and dropped.
+func loadPending(h map[string]string, v interface{}) {
+	if h["pending"] == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(h["pending"]), v); err != nil {
+		log.Printf("dropping undecodable pending events: %v", err)
+	}
+}
+
+// savePending puts events whose insert failed back into their buses' state
+// hashes. events maps a bus to a slice of its events.
+func savePending(ctx context.Context, r *redisclient.Client, key func(string) string, ttl time.Duration, events map[string]interface{}) error {
+	pipe := r.RDB().Pipeline()
+	for busID, evs := range events {
+		b, err := json.Marshal(evs)
+		if err != nil {
+			return err
+		}
+		appendPendingScript.Eval(ctx, pipe, []string{key(busID)}, string(b), ttl.Milliseconds())
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// groupByBus returns the buses of fixes in order of first appearance and the
+// indexes of each bus's fixes.
+func groupByBus(fixes []db.PositionRow) ([]string, map[string][]int) {
+	byBus := make(map[string][]int)
+	var busIDs []string
+	for i, f := range fixes {
+		if _, ok := byBus[f.BusID]; !ok {
+			busIDs = append(busIDs, f.BusID)
+		}
+		byBus[f.BusID] = append(byBus[f.BusID], i)
+	}
+	return busIDs, byBus
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	db "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+)
+
+const (
+	// stopEventsChannel carries stop events to the websocket broker.
+	stopEventsChannel = "events:stops"
+	// stopStateTTL drops the visit state of buses that stopped reporting.
+	stopStateTTL = 24 * time.Hour
+)
+
+// stopDetector turns fixes into arrived/departed events at the stops of each
+// bus's route. A bus arrives with its first fix within radius meters of a
+// stop and departs with its first fix outside it; the departure is dated to
+// the last fix at the stop, so dwell is the time the bus was seen there.
+//
+// The current visit of each bus is kept in vehicle:<id>:stop, so whichever
+// worker reads the next fix continues it. The state is only replaced if no
+// other worker changed it meanwhile (see updateStates), and fixes not newer
+// than the last one handled are skipped, which also makes redelivered and
+// out-of-order messages harmless. Events that fail to insert are kept in the
+// state and retried with the bus's next fixes.
+type stopDetector struct {
+	r      *redisclient.Client
+	radius float64
+}
+
+// stopState is vehicle:<id>:stop. StopID is empty between stops.
+type stopState struct {
+	StopID    string
+	RouteID   string
+	ArrivedAt int64
+	SeenAt    int64
+	Ts        int64
+}
+
+func (s *stopState) values() map[string]interface{} {
+	return map[string]interface{}{
+		"stopId": s.StopID, "routeId": s.RouteID, "arrivedAt": s.ArrivedAt, "seenAt": s.SeenAt, "ts": s.Ts,
+	}
+}
+
+func parseStopState(h map[string]string) *stopState {
+	s := &stopState{StopID: h["stopId"], RouteID: h["routeId"]}
+	s.ArrivedAt, _ = strconv.ParseInt(h["arrivedAt"], 10, 64)
+	s.SeenAt, _ = strconv.ParseInt(h["seenAt"], 10, 64)
+	s.Ts, _ = strconv.ParseInt(h["ts"], 10, 64)
+	return s
+}
+
+// detect processes committed fixes. Fixes without a route are ignored.
+func (d *stopDetector) detect(ctx context.Context, rows []db.PositionRow) error {
+	var fixes []db.PositionRow
+	for _, row := range rows {
+		if row.RouteID != nil {
+			fixes = append(fixes, row)
+		}
+	}
+	if len(fixes) == 0 {
+		return nil
+	}
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].Ts < fixes[j].Ts })
+
+	probes := make([]db.StopProbe, len(fixes))
+	for i, f := range fixes {
+		probes[i] = db.StopProbe{RouteID: *f.RouteID, Lat: f.Lat, Lon: f.Lon}
+	}
+	nearest, err := db.NearestRouteStops(ctx, probes, d.radius)
+	if err != nil {
+		return err
+	}
+
+	busIDs, byBus := groupByBus(fixes)
+	claimed := make(map[string][]pendingStopEvent)
+	err = updateStates(ctx, d.r, stopStateKey, busIDs, stopStateTTL, func(busID string, h map[string]string) (map[string]interface{}, func()) {
+		st := parseStopState(h)
+		var evs []pendingStopEvent
+		loadPending(h, &evs)
+		emit := func(ev db.StopEvent, f *db.PositionRow) {
+			evs = append(evs, pendingStopEvent{Event: ev, Payload: stopEventPayload(&ev, f)})
+		}
+		advanced := false
+		for _, i := range byBus[busID] {
+			f := &fixes[i]
+			if f.Ts <= st.Ts {
+				continue
+			}
+			cur := nearest[i]
+			if st.StopID != "" && (cur == nil || cur.ID != st.StopID) {
+				dwell := int(st.SeenAt - st.ArrivedAt)
+				emit(db.StopEvent{BusID: f.BusID, RouteID: nullable(st.RouteID), StopID: st.StopID, Event: db.StopDeparted, Ts: time.Unix(st.SeenAt, 0), DwellSeconds: &dwell}, f)
+				st.StopID, st.RouteID = "", ""
+			}
+			if cur != nil {
+				if st.StopID == "" {
+					emit(db.StopEvent{BusID: f.BusID, RouteID: f.RouteID, StopID: cur.ID, Event: db.StopArrived, Ts: time.Unix(f.Ts, 0)}, f)
+					st.StopID, st.RouteID, st.ArrivedAt = cur.ID, *f.RouteID, f.Ts
+				}
+				st.SeenAt = f.Ts
+			}
+			st.Ts = f.Ts
+			advanced = true
+		}
+		if !advanced && h["pending"] == "" {
+			return nil, nil
+		}
+		return st.values(), func() {
+			if len(evs) > 0 {
+				claimed[busID] = evs
+			}
+		}
+	})
+
+	// events of buses whose state was stored are kept even if others failed
+	if len(claimed) > 0 {
+		if serr := d.store(ctx, busIDs, claimed); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// pendingStopEvent is a stop event and its websocket payload, kept in the
+// bus's state while it waits to be stored.
+type pendingStopEvent struct {
+	Event   db.StopEvent
+	Payload string
+}
+
+// store inserts and publishes the events claimed from each bus's state. If
+// the insert fails they are put back into the state, so the bus's next update
+// retries them.
+func (d *stopDetector) store(ctx context.Context, busIDs []string, claimed map[string][]pendingStopEvent) error {
+	var events []db.StopEvent
+	var payloads []string
+	for _, id := range busIDs {
+		for _, p := range claimed[id] {
+			events, payloads = append(events, p.Event), append(payloads, p.Payload)
+		}
+	}
+	if err := db.InsertStopEvents(ctx, events); err != nil {
+		pending := make(map[string]interface{}, len(claimed))
+		for id, evs := range claimed {
+			pending[id] = evs
+		}
+		if perr := savePending(ctx, d.r, stopStateKey, stopStateTTL, pending); perr != nil {
+			return fmt.Errorf("insert stop events: %w; keeping them for retry: %v", err, perr)
+		}
+		return err
+	}
+	pipe := d.r.RDB().Pipeline()
+	for _, p := range payloads {
+		pipe.Publish(ctx, stopEventsChannel, p)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func stopStateKey(busID string) string { return "vehicle:" + busID + ":stop" }
+
+// stopEventPayload is the websocket event for ev. lat/lon are the fix that
+// triggered it, so bounding-box subscribers receive it too.
+func stopEventPayload(ev *db.StopEvent, f *db.PositionRow) string {
+	m := map[string]interface{}{
+		"type":   "stop",
+		"event":  ev.Event,
+		"busId":  ev.BusID,
+		"stopId": ev.StopID,
+		"ts":     ev.Ts.Unix(),
+		"lat":    f.Lat,
+		"lon":    f.Lon,
+	}
+	if ev.RouteID != nil {
+		m["routeId"] = *ev.RouteID
+	}
+	if ev.DwellSeconds != nil {
+		m["dwellSeconds"] = *ev.DwellSeconds
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -15,6 +15,7 @@ require (
 	github.com/redis/go-redis/v9 v9.14.0
 	github.com/spf13/viper v1.17.0
 	go.uber.org/zap v1.26.0
+	google.golang.org/protobuf v1.36.8
 )
 
 require (
@@ -70,7 +71,6 @@ require (
 	golang.org/x/sync v0.16.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
-	google.golang.org/protobuf v1.36.8 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/alexedwards/argon2id"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type UpdateMeRequest struct {
+	Name *string `json:"name" binding:"omitempty,min=2"`
+	// Phone "" clears the number.
+	Phone *string `json:"phone" binding:"omitempty,max=32"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type SessionResponse struct {
+	ID              string    `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastRefreshedAt time.Time `json:"last_refreshed_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// meResponse is the public view of a user; it never includes the password hash.
+func meResponse(u *db.User) gin.H {
+	return gin.H{
+		"id":    u.ID,
+		"name":  u.Name,
+		"email": u.Email,
+		"phone": u.Phone,
+		"role":  u.Role,
+		// email_verified lets clients prompt for verification.
+		"email_verified": u.EmailVerifiedAt != nil,
+	}
+}
+
+// UpdateMeHandler updates the caller's name and/or phone.
+func UpdateMeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req UpdateMeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		u, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		name, phone := u.Name, u.Phone
+		if req.Name != nil {
+			name = *req.Name
+		}
+		if req.Phone != nil {
+			phone = req.Phone
+			if *phone == "" {
+				phone = nil
+			}
+		}
+		u, err := db.UpdateUserProfile(ctx, u.ID, name, phone)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+			return
+		}
+		c.JSON(http.StatusOK, meResponse(u))
+	}
+}
+
+// ChangePasswordHandler replaces the caller's password after re-verifying the
+// current one, and signs out every session, including live access tokens.
+func ChangePasswordHandler(jwtMgr *JWTManager, denylist *Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ChangePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		u, ok := currentUser(c)
+		if !ok || !verifyPassword(c, u, req.CurrentPassword) {
+			return
+		}
+		hash, err := argon2id.CreateHash(req.NewPassword, argon2id.DefaultParams)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
+			return
+		}
+		if err := db.UpdateUserPassword(ctx, u.ID, hash); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+			return
+		}
+		if err := RevokeUser(ctx, jwtMgr, denylist, u.ID, db.RevokedPasswordChange); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// SessionsHandler lists the caller's active refresh-token sessions.
+func SessionsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := db.ListSessions(c.Request.Context(), c.GetString("uid"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "session lookup failed"})
+			return
+		}
+		out := make([]SessionResponse, len(sessions))
+		for i, s := range sessions {
+			out[i] = SessionResponse(s)
+		}
+		c.JSON(http.StatusOK, gin.H{"sessions": out})
+	}
+}
+
+// RevokeAllSessionsHandler signs the caller out everywhere: every refresh
+// token and every access token issued so far, including the current one.
+func RevokeAllSessionsHandler(jwtMgr *JWTManager, denylist *Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := RevokeUser(c.Request.Context(), jwtMgr, denylist, c.GetString("uid"), db.RevokedLogoutAll); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// RevokeSessionHandler revokes one of the caller's sessions (a refresh token
+// family), signing that device out once its access token expires.
+func RevokeSessionHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := uuid.Parse(id); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		err := db.RevokeSession(c.Request.Context(), c.GetString("uid"), id)
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// DeleteMeHandler deletes the caller's account after re-verifying the password.
+// Its access tokens are denylisted too, but a failure there is only logged:
+// the account is gone by then, so refreshes and /auth/me lookups fail anyway.
+func DeleteMeHandler(jwtMgr *JWTManager, denylist *Denylist, logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DeleteAccountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		u, ok := currentUser(c)
+		if !ok || !verifyPassword(c, u, req.Password) {
+			return
+		}
+		if err := db.DeleteUser(c.Request.Context(), u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+			return
+		}
+		if err := denylist.RevokeAll(c.Request.Context(), u.ID, jwtMgr.TTL()); err != nil {
+			logger.Error("denylist deleted user failed", zap.String("user", u.ID), zap.Error(err))
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// RevokeUser revokes every refresh token of a user and denylists all of their
+// access tokens issued so far.
+func RevokeUser(ctx context.Context, jwtMgr *JWTManager, denylist *Denylist, userID, reason string) error {
+	if err := db.RevokeUserSessions(ctx, userID, reason); err != nil {
+		return err
+	}
+	return denylist.RevokeAll(ctx, userID, jwtMgr.TTL())
+}
+
+// currentUser loads the authenticated user, answering 404 if the account no
+// longer exists.
+func currentUser(c *gin.Context) (*db.User, bool) {
+	u, err := db.GetUserByID(c.Request.Context(), c.GetString("uid"))
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user lookup failed"})
+		return nil, false
+	}
+	return u, true
+}
+
+// verifyPassword checks password against u, answering 401 when it is wrong.
+func verifyPassword(c *gin.Context, u *db.User, password string) bool {
+	ok, err := argon2id.ComparePasswordAndHash(password, u.PasswordHash)
+	if err != nil || !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return false
+	}
+	return true
+}
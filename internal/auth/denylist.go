@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Denylist revokes access tokens before they expire. Single tokens are
+// denylisted by jti until their own expiry; RevokeAll records a cutoff per
+// subject (user id or bus id) and rejects every token issued at or before it.
+type Denylist struct {
+	rdb *redis.Client
+}
+
+func NewDenylist(rdb *redis.Client) *Denylist {
+	return &Denylist{rdb: rdb}
+}
+
+func jtiKey(jti string) string { return "auth:denylist:jti:" + jti }
+func subKey(sub string) string { return "auth:denylist:sub:" + sub }
+
+// subject identifies whose token this is. Older user tokens carry no sub.
+func subject(claims *Claims) string {
+	if claims.Subject != "" {
+		return claims.Subject
+	}
+	return claims.UserID
+}
+
+// Revoke denylists a single token for the rest of its lifetime.
+func (d *Denylist) Revoke(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return errors.New("token has no jti")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.rdb.Set(ctx, jtiKey(claims.ID), 1, ttl).Err()
+}
+
+// RevokeAll rejects every token of sub issued up to now. ttl must cover the
+// lifetime of the longest-lived token the subject can hold.
+func (d *Denylist) RevokeAll(ctx context.Context, sub string, ttl time.Duration) error {
+	return d.rdb.Set(ctx, subKey(sub), time.Now().UnixMilli(), ttl).Err()
+}
+
+// IsRevoked reports whether the token was revoked individually or by a
+// RevokeAll for its subject.
+func (d *Denylist) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	pipe := d.rdb.Pipeline()
+	var jti *redis.IntCmd
+	if claims.ID != "" {
+		jti = pipe.Exists(ctx, jtiKey(claims.ID))
+	}
+	cutoff := pipe.Get(ctx, subKey(subject(claims)))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if jti != nil && jti.Val() > 0 {
+		return true, nil
+	}
+	if s, err := cutoff.Result(); err == nil {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		if claims.IssuedAt == nil || claims.IssuedAt.UnixMilli() <= ts {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/mail"
+	"github.com/alexedwards/argon2id"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	verifyEmailTTL   = 24 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+// AccountEmails issues the single-use tokens behind the verify-email and
+// reset-password links and mails them to the user.
+type AccountEmails struct {
+	mailer   mail.Mailer
+	linkBase string
+	logger   *zap.Logger
+}
+
+func NewAccountEmails(mailer mail.Mailer, linkBaseURL string, logger *zap.Logger) *AccountEmails {
+	return &AccountEmails{mailer: mailer, linkBase: strings.TrimRight(linkBaseURL, "/"), logger: logger}
+}
+
+// SendVerification mails u a link that verifies their email address.
+func (e *AccountEmails) SendVerification(ctx context.Context, u *db.User) error {
+	link, err := e.issue(ctx, u.ID, db.TokenVerifyEmail, verifyEmailTTL, "/verify-email")
+	if err != nil {
+		return err
+	}
+	return e.mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Verify your email address",
+		Body: "Hi " + u.Name + ",\n\n" +
+			"Confirm your email address by opening this link within 24 hours:\n\n" + link + "\n",
+	})
+}
+
+// SendPasswordReset mails u a link that lets them choose a new password.
+func (e *AccountEmails) SendPasswordReset(ctx context.Context, u *db.User) error {
+	link, err := e.issue(ctx, u.ID, db.TokenResetPassword, resetPasswordTTL, "/reset-password")
+	if err != nil {
+		return err
+	}
+	return e.mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: "Hi " + u.Name + ",\n\n" +
+			"Someone asked to reset the password for this account. Open this link within an hour to choose a new one:\n\n" + link + "\n\n" +
+			"If it wasn't you, ignore this email; your password stays unchanged.\n",
+	})
+}
+
+// issue stores a new token for purpose and returns the link carrying it.
+func (e *AccountEmails) issue(ctx context.Context, userID, purpose string, ttl time.Duration, path string) (string, error) {
+	raw, err := GenerateRandom(32)
+	if err != nil {
+		return "", err
+	}
+	if err := db.CreateAccountToken(ctx, userID, purpose, hashToken(raw), time.Now().Add(ttl)); err != nil {
+		return "", err
+	}
+	return e.linkBase + path + "?token=" + url.QueryEscape(raw), nil
+}
+
+func hashToken(raw string) string {
+	h := sha256.Sum256([]byte(raw))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// RequestVerificationHandler re-sends the verification email to the caller.
+func RequestVerificationHandler(emails *AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if u.EmailVerifiedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "email already verified"})
+			return
+		}
+		if err := emails.SendVerification(c.Request.Context(), u); err != nil {
+			emails.logger.Error("send verification email failed", zap.String("user", u.ID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "send failed"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "sent"})
+	}
+}
+
+// VerifyEmailHandler redeems a verification token.
+func VerifyEmailHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req VerifyEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		_, err := db.VerifyEmail(c.Request.Context(), hashToken(req.Token))
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "verify failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "verified"})
+	}
+}
+
+// ForgotPasswordHandler mails a reset link if the address belongs to an
+// account. It answers 202 either way so it cannot be used to probe for
+// registered emails.
+func ForgotPasswordHandler(emails *AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req EmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		u, err := db.FindUserByEmail(ctx, req.Email)
+		if err == nil {
+			if err := emails.SendPasswordReset(ctx, u); err != nil {
+				emails.logger.Error("send password reset email failed", zap.String("user", u.ID), zap.Error(err))
+			}
+		} else if !errors.Is(err, db.ErrNotFound) {
+			emails.logger.Error("password reset lookup failed", zap.Error(err))
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "if the account exists, an email has been sent"})
+	}
+}
+
+// ResetPasswordHandler redeems a reset token, sets the new password and signs
+// out every session, like a password change.
+func ResetPasswordHandler(jwtMgr *JWTManager, denylist *Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		hash, err := argon2id.CreateHash(req.NewPassword, argon2id.DefaultParams)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
+			return
+		}
+		userID, err := db.ResetPassword(ctx, hashToken(req.Token), hash)
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "reset failed"})
+			return
+		}
+		if err := RevokeUser(ctx, jwtMgr, denylist, userID, db.RevokedPasswordReset); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
@@ -3,13 +3,20 @@ package auth
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/metrics"
 	"github.com/alexedwards/argon2id"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
 type RegisterRequest struct {
@@ -30,30 +37,52 @@ type TokenResponse struct {
 	ExpiresIn    int64  `json:"expires_in"`
 }
 
-// Register handler
-func RegisterHandler(c *gin.Context) {
-	var req RegisterRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// Register handler. A verification email is sent to the new address; a
+// delivery failure does not fail registration since the user can ask for
+// another one.
+func RegisterHandler(emails *AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RegisterRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		// Hash password with Argon2id
+		hash, err := argon2id.CreateHash(req.Password, argon2id.DefaultParams)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
+			return
+		}
+		id := uuid.New().String()
+		if err := db.InsertUser(ctx, id, req.Name, req.Email, hash); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db insert failed"})
+			return
+		}
+		u := &db.User{ID: id, Name: req.Name, Email: req.Email}
+		if err := emails.SendVerification(ctx, u); err != nil {
+			emails.logger.Error("send verification email failed", zap.String("user", id), zap.Error(err))
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id, "email": req.Email})
 	}
-	ctx := c.Request.Context()
-	// Hash password with Argon2id
-	hash, err := argon2id.CreateHash(req.Password, argon2id.DefaultParams)
+}
+
+// dummyHash is compared against when the email is unknown, so a login for a
+// missing account takes as long as one with a wrong password.
+var dummyHash = sync.OnceValue(func() string {
+	h, err := argon2id.CreateHash("dummy-password-for-timing", argon2id.DefaultParams)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
-		return
+		panic(err)
 	}
-	id := uuid.New().String()
-	if err := db.InsertUser(ctx, id, req.Name, req.Email, hash); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "db insert failed"})
-		return
-	}
-	c.JSON(http.StatusCreated, gin.H{"id": id, "email": req.Email})
-}
+	return h
+})
 
-// Login handler
-func LoginHandler(jwtMgr *JWTManager) gin.HandlerFunc {
+// Login handler. Attempts are counted per account and per client IP before
+// the password is checked and taken back when it matches; past a few
+// failures further attempts are refused with 429 and Retry-After, with
+// exponentially growing delays up to a temporary lockout.
+func LoginHandler(jwtMgr *JWTManager, throttle *LoginThrottle, logger *zap.Logger) gin.HandlerFunc {
+	dummyHash() // hash up front rather than during the first unknown-email login
 	return func(c *gin.Context) {
 		var req LoginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -61,16 +90,50 @@ func LoginHandler(jwtMgr *JWTManager) gin.HandlerFunc {
 			return
 		}
 		ctx := c.Request.Context()
-		u, err := db.FindUserByEmail(ctx, req.Email)
+		ip := c.ClientIP()
+		attempt, err := throttle.Attempt(ctx, req.Email, ip)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			logger.Error("login throttle check failed", zap.Error(err))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "login temporarily unavailable"})
 			return
 		}
-		ok, err := argon2id.ComparePasswordAndHash(req.Password, u.PasswordHash)
-		if err != nil || !ok {
+		if attempt.Wait > 0 {
+			metrics.LoginLocked.WithLabelValues(attempt.Scope).Inc()
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(attempt.Wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed login attempts"})
+			return
+		}
+
+		u, err := db.FindUserByEmail(ctx, req.Email)
+		hash := dummyHash()
+		switch {
+		case err == nil:
+			hash = u.PasswordHash
+		case !errors.Is(err, db.ErrNotFound):
+			// not the caller's fault: take the charge back rather than
+			// counting it as a failure
+			logger.Error("login user lookup failed", zap.Error(err))
+			if err := throttle.Refund(ctx, attempt); err != nil {
+				logger.Error("login throttle refund failed", zap.Error(err))
+			}
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "login temporarily unavailable"})
+			return
+		}
+		ok, cmpErr := argon2id.ComparePasswordAndHash(req.Password, hash)
+		if err != nil || cmpErr != nil || !ok {
+			metrics.LoginFailed.Inc()
+			if throttle.Locked(attempt.Failures) {
+				logger.Warn("security: login locked after repeated failures",
+					zap.String("email", req.Email),
+					zap.Int64("failures", attempt.Failures),
+					zap.String("ip", ip))
+			}
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 			return
 		}
+		if err := throttle.Succeed(ctx, attempt); err != nil {
+			logger.Error("login throttle reset failed", zap.Error(err))
+		}
 		// Generate access token
 		access, err := jwtMgr.GenerateToken(u.ID, u.Role)
 		if err != nil {
@@ -97,8 +160,10 @@ func LoginHandler(jwtMgr *JWTManager) gin.HandlerFunc {
 	}
 }
 
-// Refresh handler: rotate refresh token
-func RefreshHandler(jwtMgr *JWTManager) gin.HandlerFunc {
+// Refresh handler: rotate refresh token. Presenting a token that was already
+// rotated revokes its whole family, since either the client or an attacker
+// holds a stolen copy.
+func RefreshHandler(jwtMgr *JWTManager, logger *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var body struct {
 			RefreshToken string `json:"refresh_token" binding:"required"`
@@ -108,30 +173,34 @@ func RefreshHandler(jwtMgr *JWTManager) gin.HandlerFunc {
 			return
 		}
 		ctx := c.Request.Context()
-		// Lookup refresh token hash in DB and check not revoked and not expired
 		h := sha256.Sum256([]byte(body.RefreshToken))
 		refreshHash := base64.RawURLEncoding.EncodeToString(h[:])
-		userID, ok, err := db.GetUserIDByRefreshHash(ctx, refreshHash)
-		if err != nil || !ok {
+		newRaw := uuid.New().String() + "-" + time.Now().Format(time.RFC3339Nano)
+		h2 := sha256.Sum256([]byte(newRaw))
+		newHash := base64.RawURLEncoding.EncodeToString(h2[:])
+		exp := time.Now().Add(30 * 24 * time.Hour)
+		// rotate: check, revoke the old token and store the new one atomically
+		old, err := db.RotateRefreshToken(ctx, refreshHash, newHash, exp)
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			logger.Warn("security: refresh token reuse detected, family revoked",
+				zap.String("user", old.UserID),
+				zap.String("family", old.FamilyID),
+				zap.String("token", old.ID),
+				zap.String("ip", c.ClientIP()),
+				zap.String("user_agent", c.Request.UserAgent()))
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
 			return
 		}
-		// rotate: revoke old token and create a new refresh token
-		if err := db.RevokeRefreshTokenByHash(ctx, refreshHash); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
 			return
 		}
-		// new refresh token
-		newRaw := uuid.New().String() + "-" + time.Now().Format(time.RFC3339Nano)
-		h2 := sha256.Sum256([]byte(newRaw))
-		newHash := base64.RawURLEncoding.EncodeToString(h2[:])
-		exp := time.Now().Add(30 * 24 * time.Hour)
-		if err := db.StoreRefreshToken(ctx, userID, newHash, exp); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "store refresh failed"})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "rotate failed"})
 			return
 		}
 		// issue new access token
-		user, err := db.GetUserByID(ctx, userID)
+		user, err := db.GetUserByID(ctx, old.UserID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "user lookup failed"})
 			return
@@ -150,8 +219,9 @@ func RefreshHandler(jwtMgr *JWTManager) gin.HandlerFunc {
 	}
 }
 
-// Logout (revoke a refresh token)
-func LogoutHandler() gin.HandlerFunc {
+// Logout (revoke the session the refresh token belongs to). An access token
+// sent as a bearer token is denylisted as well.
+func LogoutHandler(jwtMgr *JWTManager, denylist *Denylist) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var body struct {
 			RefreshToken string `json:"refresh_token" binding:"required"`
@@ -163,10 +233,18 @@ func LogoutHandler() gin.HandlerFunc {
 		ctx := c.Request.Context()
 		h := sha256.Sum256([]byte(body.RefreshToken))
 		refreshHash := base64.RawURLEncoding.EncodeToString(h[:])
-		if err := db.RevokeRefreshTokenByHash(ctx, refreshHash); err != nil {
+		if err := db.RevokeRefreshFamilyByHash(ctx, refreshHash, db.RevokedLogout); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
 			return
 		}
+		if parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2); len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+			if claims, err := jwtMgr.ValidateToken(parts[1]); err == nil && claims.ID != "" {
+				if err := denylist.Revoke(ctx, claims); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+					return
+				}
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	}
 }
@@ -180,16 +258,14 @@ func MeHandler() gin.HandlerFunc {
 			return
 		}
 		user, err := db.GetUserByID(c.Request.Context(), uid)
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "user lookup failed"})
 			return
 		}
-		// hide password hash
-		c.JSON(http.StatusOK, gin.H{
-			"id":    user.ID,
-			"name":  user.Name,
-			"email": user.Email,
-			"role":  user.Role,
-		})
+		c.JSON(http.StatusOK, meResponse(user))
 	}
 }
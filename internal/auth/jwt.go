@@ -1,20 +1,28 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"context"
 	"errors"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
-// JWTManager manages RSA-signed JWTs
+// JWTManager manages RSA-signed JWTs. Tokens are signed with the newest key
+// and carry its kid; every loaded key is accepted for validation, so tokens
+// signed before a rotation stay valid until they expire or their key is
+// removed.
 type JWTManager struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-	issuer     string
-	ttl        time.Duration
+	source keySource
+	issuer string
+	ttl    time.Duration
+
+	mu    sync.RWMutex
+	keys  *keySet
+	stamp string
 }
 
 // TTL returns the token time-to-live duration
@@ -22,41 +30,105 @@ func (m *JWTManager) TTL() time.Duration {
 	return m.ttl
 }
 
+// RoleDevice is the role of tokens issued to on-board devices; such tokens
+// carry the bus they may report for in BusID.
+const RoleDevice = "device"
+
 type Claims struct {
 	UserID string `json:"user_id"`
 	Role   string `json:"role"`
+	BusID  string `json:"bus_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// NewJWTManagerFromFiles loads keys from file paths
+// NewJWTManagerFromFiles loads a single key pair from file paths
 func NewJWTManagerFromFiles(privPath, pubPath, issuer string, ttl time.Duration) (*JWTManager, error) {
-	// Read and parse private key
-	privBytes, err := os.ReadFile(privPath)
-	if err != nil {
-		return nil, errors.New("failed to read private key file: " + err.Error())
-	}
+	return newJWTManager(pairSource{privPath: privPath, pubPath: pubPath}, issuer, ttl)
+}
 
-	privKey, err := jwt.ParseRSAPrivateKeyFromPEM(privBytes)
-	if err != nil {
-		// Try without password if first attempt fails
-		privKey, err = jwt.ParseRSAPrivateKeyFromPEMWithPassword(privBytes, "")
-		if err != nil {
-			return nil, errors.New("failed to parse private key: " + err.Error())
-		}
+// NewJWTManagerFromDir loads every key in dir; see dirSource for the layout.
+func NewJWTManagerFromDir(dir, issuer string, ttl time.Duration) (*JWTManager, error) {
+	return newJWTManager(dirSource{dir: dir}, issuer, ttl)
+}
+
+func newJWTManager(src keySource, issuer string, ttl time.Duration) (*JWTManager, error) {
+	// Denylist cutoffs are in milliseconds, so iat must be too, or a token
+	// issued right after a RevokeAll (e.g. the refresh following a role
+	// change) is caught by it. TimePrecision is global to the jwt package and
+	// applies to every token this process encodes or decodes.
+	jwt.TimePrecision = time.Millisecond
+	m := &JWTManager{source: src, issuer: issuer, ttl: ttl}
+	if _, err := m.Reload(); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	// Read and parse public key
-	pubBytes, err := os.ReadFile(pubPath)
+// Reload re-reads the key files if they changed since the last load and
+// reports whether the key set was replaced. On error the current keys stay in
+// use.
+func (m *JWTManager) Reload() (bool, error) {
+	stamp := m.source.fingerprint()
+	m.mu.RLock()
+	unchanged := m.keys != nil && stamp == m.stamp
+	m.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	keys, err := m.source.load()
 	if err != nil {
-		return nil, errors.New("failed to read public key file: " + err.Error())
+		return false, err
 	}
+	m.mu.Lock()
+	m.keys, m.stamp = keys, stamp
+	m.mu.Unlock()
+	return true, nil
+}
 
-	pubKey, err := jwt.ParseRSAPublicKeyFromPEM(pubBytes)
-	if err != nil {
-		return nil, errors.New("failed to parse public key: " + err.Error())
+// WatchKeys polls the key files every interval and reloads them when they
+// change, until ctx is done.
+func (m *JWTManager) WatchKeys(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := m.Reload()
+			if err != nil {
+				logger.Error("jwt key reload failed, keeping current keys", zap.Error(err))
+				continue
+			}
+			if changed {
+				logger.Info("jwt keys reloaded", zap.String("signing_kid", m.SigningKeyID()), zap.Int("keys", len(m.JWKS().Keys)))
+			}
+		}
 	}
+}
 
-	return &JWTManager{privateKey: privKey, publicKey: pubKey, issuer: issuer, ttl: ttl}, nil
+// SigningKeyID returns the kid new tokens are signed with.
+func (m *JWTManager) SigningKeyID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys.signing.kid
+}
+
+// JWKS returns the public keys tokens are currently accepted from.
+func (m *JWTManager) JWKS() JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys.jwks()
+}
+
+// sign signs claims with the current signing key and sets its kid header.
+func (m *JWTManager) sign(claims *Claims) (string, error) {
+	m.mu.RLock()
+	k := m.keys.signing
+	m.mu.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.key)
 }
 
 // GenerateToken generates a new JWT token for a user
@@ -65,6 +137,8 @@ func (m *JWTManager) GenerateToken(userID, role string) (string, error) {
 		UserID: userID,
 		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   userID,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(m.ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -72,23 +146,61 @@ func (m *JWTManager) GenerateToken(userID, role string) (string, error) {
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(m.privateKey)
+	return m.sign(claims)
+}
+
+// GenerateDeviceToken issues a device token bound to busID. Devices cannot
+// refresh, so ttl is normally much longer than the user access token TTL.
+func (m *JWTManager) GenerateDeviceToken(busID string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(ttl)
+	claims := &Claims{
+		Role:  RoleDevice,
+		BusID: busID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   busID,
+			ExpiresAt: jwt.NewNumericDate(exp),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    m.issuer,
+		},
+	}
+
+	token, err := m.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, exp, nil
 }
 
-// ValidateToken validates the given token string
+// ValidateToken validates the given token string. The key is chosen by the
+// kid header; tokens issued before kids existed are tried against every key.
 func (m *JWTManager) ValidateToken(tokenStr string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(
-		tokenStr,
-		&Claims{},
-		func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, errors.New("unexpected token signing method")
+	m.mu.RLock()
+	keys := m.keys
+	m.mu.RUnlock()
+
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected token signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			vks := jwt.VerificationKeySet{}
+			for _, pub := range keys.verify {
+				vks.Keys = append(vks.Keys, pub)
 			}
-			return m.publicKey, nil
-		},
-	)
+			return vks, nil
+		}
+		pub, ok := keys.verify[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return pub, nil
+	}
 
+	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, keyFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -99,4 +211,4 @@ func (m *JWTManager) ValidateToken(tokenStr string) (*Claims, error) {
 	}
 
 	return claims, nil
-}
\ No newline at end of file
+}
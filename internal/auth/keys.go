@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a private key together with its kid.
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// keySet is one loaded generation of keys: the key new tokens are signed
+// with, and every public key tokens are still accepted from.
+type keySet struct {
+	signing *signingKey
+	verify  map[string]*rsa.PublicKey
+}
+
+// keySource loads a keySet and reports a fingerprint of its files, so a
+// reload is only attempted when something changed on disk.
+type keySource interface {
+	load() (*keySet, error)
+	fingerprint() string
+}
+
+// pairSource is the original single key pair from JWT_PRIVATE_KEY_PATH and
+// JWT_PUBLIC_KEY_PATH.
+type pairSource struct {
+	privPath, pubPath string
+}
+
+func (s pairSource) load() (*keySet, error) {
+	priv, err := readPrivateKey(s.privPath)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes, err := os.ReadFile(s.pubPath)
+	if err != nil {
+		return nil, errors.New("failed to read public key file: " + err.Error())
+	}
+	pub, err := jwt.ParseRSAPublicKeyFromPEM(pubBytes)
+	if err != nil {
+		return nil, errors.New("failed to parse public key: " + err.Error())
+	}
+	if pub.N.Cmp(priv.N) != 0 || pub.E != priv.E {
+		return nil, errors.New("public key does not match private key")
+	}
+	kid := thumbprint(pub)
+	return &keySet{
+		signing: &signingKey{kid: kid, key: priv},
+		verify:  map[string]*rsa.PublicKey{kid: pub},
+	}, nil
+}
+
+func (s pairSource) fingerprint() string {
+	return fileStamp(s.privPath) + "|" + fileStamp(s.pubPath)
+}
+
+// dirSource reads every key in a directory. "<name>.pem" files are private
+// keys and "<name>.pub.pem" files are verification-only public keys. The
+// private key with the greatest file name signs, so naming keys by creation
+// date (2025-07-01.pem) makes the newest one active.
+type dirSource struct {
+	dir string
+}
+
+func (s dirSource) files() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (s dirSource) load() (*keySet, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	set := &keySet{verify: make(map[string]*rsa.PublicKey)}
+	for _, f := range files {
+		if strings.HasSuffix(f, ".pub.pem") {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			pub, err := jwt.ParseRSAPublicKeyFromPEM(b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse public key %s: %w", filepath.Base(f), err)
+			}
+			set.verify[thumbprint(pub)] = pub
+			continue
+		}
+		priv, err := readPrivateKey(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(f), err)
+		}
+		kid := thumbprint(&priv.PublicKey)
+		set.verify[kid] = &priv.PublicKey
+		// files are sorted, so the last private key wins
+		set.signing = &signingKey{kid: kid, key: priv}
+	}
+	if set.signing == nil {
+		return nil, fmt.Errorf("no private key (*.pem) in %s", s.dir)
+	}
+	return set, nil
+}
+
+func (s dirSource) fingerprint() string {
+	files, _ := s.files()
+	stamps := make([]string, len(files))
+	for i, f := range files {
+		stamps[i] = fileStamp(f)
+	}
+	return strings.Join(stamps, "|")
+}
+
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("failed to read private key file: " + err.Error())
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+	if err != nil {
+		return nil, errors.New("failed to parse private key: " + err.Error())
+	}
+	return key, nil
+}
+
+func fileStamp(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return path + ":missing"
+	}
+	return fmt.Sprintf("%s:%d:%d", path, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of an RSA public key, used as kid.
+func thumbprint(pub *rsa.PublicKey) string {
+	// Members in lexicographic order, no whitespace, as the RFC requires.
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64uint(big.NewInt(int64(pub.E))), b64uint(pub.N))
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func b64uint(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// JWK is the public half of a signing key in JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (s *keySet) jwks() JWKS {
+	kids := make([]string, 0, len(s.verify))
+	for kid := range s.verify {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	out := JWKS{Keys: make([]JWK, 0, len(kids))}
+	for _, kid := range kids {
+		pub := s.verify[kid]
+		out.Keys = append(out.Keys, JWK{
+			Kty: "RSA", Use: "sig", Alg: "RS256", Kid: kid,
+			N: b64uint(pub.N), E: b64uint(big.NewInt(int64(pub.E))),
+		})
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package auth
+
+// Roles. Every user has exactly one; RoleDevice is only ever carried by
+// device tokens and cannot be assigned to a user.
+const (
+	RoleAdmin      = "admin"
+	RoleDispatcher = "dispatcher"
+	RoleDriver     = "driver"
+	RoleRider      = "rider"
+)
+
+// Permissions checked by middleware.RequirePermission and the websocket broker.
+const (
+	// PermVehiclesRead allows live and historical vehicle queries and
+	// subscribing to individual buses, routes or areas on /ws.
+	PermVehiclesRead = "vehicles:read"
+	// PermVehiclesReadAll allows following every vehicle at once on /ws.
+	PermVehiclesReadAll = "vehicles:read_all"
+	// PermPositionsWrite allows location ingest.
+	PermPositionsWrite = "positions:write"
+	PermFleetRead      = "fleet:read"
+	PermFleetWrite     = "fleet:write"
+	// PermDevicesManage allows issuing device tokens.
+	PermDevicesManage = "devices:manage"
+	PermUsersManage   = "users:manage"
+	// PermOpsManage covers the DLQ and partition admin endpoints.
+	PermOpsManage = "ops:manage"
+)
+
+var rolePermissions = map[string]map[string]bool{
+	RoleAdmin: set(PermVehiclesRead, PermVehiclesReadAll, PermFleetRead, PermFleetWrite,
+		PermDevicesManage, PermUsersManage, PermOpsManage),
+	RoleDispatcher: set(PermVehiclesRead, PermVehiclesReadAll, PermFleetRead, PermFleetWrite),
+	RoleDriver:     set(PermVehiclesRead, PermFleetRead),
+	RoleRider:      set(PermVehiclesRead, PermFleetRead),
+	RoleDevice:     set(PermPositionsWrite),
+}
+
+func set(perms ...string) map[string]bool {
+	m := make(map[string]bool, len(perms))
+	for _, p := range perms {
+		m[p] = true
+	}
+	return m
+}
+
+// HasPermission reports whether role grants perm. Unknown roles grant nothing.
+func HasPermission(role, perm string) bool {
+	return rolePermissions[role][perm]
+}
+
+// IsUserRole reports whether role may be assigned to a user account.
+func IsUserRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleDispatcher, RoleDriver, RoleRider:
+		return true
+	}
+	return false
+}
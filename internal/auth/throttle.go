@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ThrottlePolicy describes how failed logins slow down one account or IP.
+// The first FreeAttempts failures cost nothing; each further failure blocks
+// the next attempt for BaseDelay, doubling every time up to MaxDelay, and
+// LockAfter failures lock the scope out for Lockout. Counters reset Lockout
+// after the last failure. See attemptScript.
+type ThrottlePolicy struct {
+	FreeAttempts int
+	LockAfter    int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Lockout      time.Duration
+}
+
+// Throttle scopes, also used as the metrics label.
+const (
+	ScopeAccount = "account"
+	ScopeIP      = "ip"
+)
+
+// LoginThrottle tracks failed logins per account (email) and per client IP
+// in Redis and tells the login handler when to refuse attempts outright.
+// Unknown emails are tracked like real ones so the throttle does not reveal
+// which accounts exist.
+type LoginThrottle struct {
+	rdb     *redis.Client
+	account ThrottlePolicy
+	ip      ThrottlePolicy
+}
+
+func NewLoginThrottle(rdb *redis.Client, account, ip ThrottlePolicy) *LoginThrottle {
+	return &LoginThrottle{rdb: rdb, account: account, ip: ip}
+}
+
+func failKey(scope, id string) string  { return "auth:login:fail:" + scope + ":" + id }
+func blockKey(scope, id string) string { return "auth:login:block:" + scope + ":" + id }
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// attemptScript admits or refuses a login attempt for one account and IP
+// in a single step. A refused attempt is not counted. An admitted one is
+// charged as a failure up front, before the slow password compare, so
+// concurrent guesses cannot all pass the check before any failure lands.
+// Each scope's counter expires lockout after the last attempt, and its
+// n-th consecutive failure blocks it for delay(n): nothing for the first
+// free attempts, then base doubling up to max, and lockout from lockAfter.
+//
+// KEYS account fail, account block, ip fail, ip block
+// ARGV free, lockAfter, base ms, max ms, lockout ms for the account, then
+// the same for the IP
+// returns {blocking scope or "", wait ms or account failures, ip failures}
+var attemptScript = redis.NewScript(`
+local at = redis.call('PTTL', KEYS[2])
+local it = redis.call('PTTL', KEYS[4])
+if at > 0 or it > 0 then
+  if at >= it then return {'account', at, 0} end
+  return {'ip', it, 0}
+end
+
+local function charge(fail, block, o)
+  local free, lockAfter = tonumber(ARGV[o + 1]), tonumber(ARGV[o + 2])
+  local base, max, lockout = tonumber(ARGV[o + 3]), tonumber(ARGV[o + 4]), tonumber(ARGV[o + 5])
+  local n = redis.call('INCR', fail)
+  redis.call('PEXPIRE', fail, lockout)
+  local d = 0
+  if n >= lockAfter then
+    d = lockout
+  elseif n > free then
+    d = math.min(base * 2 ^ (n - free - 1), max)
+  end
+  if d > 0 then redis.call('SET', block, n, 'PX', math.floor(d)) end
+  return n
+end
+
+return {'', charge(KEYS[1], KEYS[2], 0), charge(KEYS[3], KEYS[4], 5)}
+`)
+
+// refundScript takes back the charge of an attempt in each scope, lifting
+// the scope's block if that attempt set it.
+//
+// KEYS fail and block key of each scope; ARGV the count each scope was
+// charged at
+var refundScript = redis.NewScript(`
+for i = 1, #ARGV do
+  local fail, block = KEYS[2 * i - 1], KEYS[2 * i]
+  if tonumber(redis.call('GET', fail) or '0') > 0 then redis.call('DECR', fail) end
+  if redis.call('GET', block) == ARGV[i] then redis.call('DEL', block) end
+end
+return 0
+`)
+
+// LoginAttempt is the throttle's verdict on one login attempt.
+type LoginAttempt struct {
+	// Scope and Wait are set when the attempt is refused.
+	Scope string
+	Wait  time.Duration
+	// Failures is the account's consecutive failure count, this attempt
+	// included.
+	Failures int64
+
+	email, ip string
+	ipCount   int64
+}
+
+func (p ThrottlePolicy) args() []interface{} {
+	return []interface{}{p.FreeAttempts, p.LockAfter, p.BaseDelay.Milliseconds(), p.MaxDelay.Milliseconds(), p.Lockout.Milliseconds()}
+}
+
+// Attempt refuses a login for email from ip while either scope is blocked,
+// and otherwise counts it as a failure until Succeed says otherwise.
+func (t *LoginThrottle) Attempt(ctx context.Context, email, ip string) (*LoginAttempt, error) {
+	id := normalizeEmail(email)
+	keys := []string{failKey(ScopeAccount, id), blockKey(ScopeAccount, id), failKey(ScopeIP, ip), blockKey(ScopeIP, ip)}
+	res, err := attemptScript.Run(ctx, t.rdb, keys, append(t.account.args(), t.ip.args()...)...).Slice()
+	if err != nil {
+		return nil, err
+	}
+	scope, _ := res[0].(string)
+	a, _ := res[1].(int64)
+	b, _ := res[2].(int64)
+	if scope != "" {
+		return &LoginAttempt{Scope: scope, Wait: time.Duration(a) * time.Millisecond}, nil
+	}
+	return &LoginAttempt{Failures: a, email: id, ip: ip, ipCount: b}, nil
+}
+
+// Succeed clears the account's failures and takes back the IP charge of a
+// successful attempt. Earlier IP failures are left alone, so an attacker
+// cannot reset them by logging into an account of their own.
+func (t *LoginThrottle) Succeed(ctx context.Context, a *LoginAttempt) error {
+	if err := t.rdb.Del(ctx, failKey(ScopeAccount, a.email), blockKey(ScopeAccount, a.email)).Err(); err != nil {
+		return err
+	}
+	return refundScript.Run(ctx, t.rdb, []string{failKey(ScopeIP, a.ip), blockKey(ScopeIP, a.ip)}, a.ipCount).Err()
+}
+
+// Refund takes back both charges of an attempt that failed for reasons other
+// than the credentials.
+func (t *LoginThrottle) Refund(ctx context.Context, a *LoginAttempt) error {
+	keys := []string{failKey(ScopeAccount, a.email), blockKey(ScopeAccount, a.email), failKey(ScopeIP, a.ip), blockKey(ScopeIP, a.ip)}
+	return refundScript.Run(ctx, t.rdb, keys, a.Failures, a.ipCount).Err()
+}
+
+// Locked reports whether n failures lock an account out rather than just
+// delaying it.
+func (t *LoginThrottle) Locked(n int64) bool {
+	return n >= int64(t.account.LockAfter)
+}
@@ -3,20 +3,33 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Config holds all configuration for our application
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Logger   LoggerConfig
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Logger    LoggerConfig
+	Vehicles  VehiclesConfig
+	WebSocket WebSocketConfig
+	Devices   DevicesConfig
+	Mail      MailConfig
+	Login     LoginConfig
+	RateLimit RateLimitConfig
+	GTFSRT    GTFSRTConfig
+	ETA       ETAConfig
 }
 
 type ServerConfig struct {
 	Port string
 	Host string
+	// TrustedProxies lists the proxy IPs or CIDRs whose X-Forwarded-For is
+	// believed. Empty means the client IP is always the peer address.
+	TrustedProxies []string
 }
 
 type DatabaseConfig struct {
@@ -32,6 +45,90 @@ type LoggerConfig struct {
 	Level string
 }
 
+type VehiclesConfig struct {
+	// StaleAfter hides vehicles from live queries once their last fix is older than this.
+	StaleAfter time.Duration
+}
+
+type WebSocketConfig struct {
+	// AllowedOrigins lists Origin values accepted on /ws. Empty means same-origin
+	// only; "*" allows any origin.
+	AllowedOrigins []string
+}
+
+type DevicesConfig struct {
+	// TokenTTL is the lifetime of device tokens issued via /api/v1/buses/:id/token.
+	TokenTTL time.Duration
+}
+
+type MailConfig struct {
+	// Driver selects the mailer: "log" writes messages to the log, "file"
+	// writes .eml files into Dir.
+	Driver string
+	Dir    string
+	From   string
+	// LinkBaseURL is the frontend origin that verification and reset links
+	// point at, e.g. https://app.example.com.
+	LinkBaseURL string
+}
+
+type LoginConfig struct {
+	// MaxAttempts consecutive failures lock an account out for Lockout;
+	// failures past a third of it already back off exponentially.
+	MaxAttempts int
+	// IPMaxAttempts is the same limit per client IP, across all accounts.
+	IPMaxAttempts int
+	Lockout       time.Duration
+}
+
+type GTFSRTConfig struct {
+	// CacheTTL is how long a built GTFS-Realtime feed is served before it is
+	// rebuilt from Redis and Postgres.
+	CacheTTL time.Duration
+}
+
+type ETAConfig struct {
+	// HistoryWindow is how far back positions are used for segment speeds.
+	HistoryWindow time.Duration
+	// CacheTTL is how long a route's speed model is reused.
+	CacheTTL time.Duration
+}
+
+type RateLimitConfig struct {
+	// Policies are tried in order; the first one matching a request's route
+	// and principal applies. See middleware.RateLimitPolicy.
+	Policies []RateLimitPolicy
+	// PreAuth policies run before token checks on user routes, so
+	// requests with bad or missing tokens are limited too. Every request
+	// counts as anonymous there.
+	PreAuth []RateLimitPolicy
+}
+
+type RateLimitPolicy struct {
+	Name      string        `mapstructure:"name"`
+	Route     string        `mapstructure:"route"`
+	Principal string        `mapstructure:"principal"`
+	Algorithm string        `mapstructure:"algorithm"`
+	Limit     int           `mapstructure:"limit"`
+	Window    time.Duration `mapstructure:"window"`
+	Burst     int           `mapstructure:"burst"`
+}
+
+// defaultRateLimitPolicies apply when the config file defines none.
+var defaultRateLimitPolicies = []map[string]any{
+	{"name": "register", "route": "/auth/register", "principal": "anonymous", "limit": 5, "window": "1h"},
+	{"name": "password-forgot", "route": "/auth/password/forgot", "principal": "anonymous", "limit": 5, "window": "1h"},
+	{"name": "auth", "route": "/auth/*", "principal": "any", "limit": 30, "window": "1m"},
+	{"name": "ingest", "route": "/api/v1/locations*", "principal": "device", "algorithm": "token_bucket", "limit": 120, "window": "1m", "burst": 60},
+	{"name": "api-user", "route": "/api/v1/*", "principal": "user", "limit": 300, "window": "1m"},
+	{"name": "api-anonymous", "route": "*", "principal": "anonymous", "limit": 60, "window": "1m"},
+}
+
+// defaultPreAuthPolicies apply when the config file defines no pre_auth list.
+var defaultPreAuthPolicies = []map[string]any{
+	{"name": "pre-auth", "route": "*", "principal": "anonymous", "limit": 600, "window": "1m"},
+}
+
 // Load reads configuration from environment variables and config files
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
@@ -42,6 +139,7 @@ func Load() (*Config, error) {
 	// Set defaults
 	viper.SetDefault("server.port", "8080")
 	viper.SetDefault("server.host", "0.0.0.0")
+	viper.SetDefault("server.trusted_proxies", []string{})
 	viper.SetDefault("database.host", "localhost")
 	viper.SetDefault("database.port", 5432)
 	viper.SetDefault("database.user", "postgres")
@@ -49,6 +147,21 @@ func Load() (*Config, error) {
 	viper.SetDefault("database.name", "postgres")
 	viper.SetDefault("database.sslmode", "disable")
 	viper.SetDefault("logger.level", "info")
+	viper.SetDefault("vehicles.stale_after", "5m")
+	viper.SetDefault("websocket.allowed_origins", []string{})
+	viper.SetDefault("devices.token_ttl", "720h")
+	viper.SetDefault("login.max_attempts", 10)
+	viper.SetDefault("login.ip_max_attempts", 100)
+	viper.SetDefault("login.lockout", "15m")
+	viper.SetDefault("ratelimit.policies", defaultRateLimitPolicies)
+	viper.SetDefault("ratelimit.pre_auth", defaultPreAuthPolicies)
+	viper.SetDefault("mail.driver", "log")
+	viper.SetDefault("mail.dir", "./mail")
+	viper.SetDefault("mail.from", "VehicleTracking <no-reply@localhost>")
+	viper.SetDefault("mail.link_base_url", "http://localhost:3000")
+	viper.SetDefault("gtfs_rt.cache_ttl", "10s")
+	viper.SetDefault("eta.history_window", "30m")
+	viper.SetDefault("eta.cache_ttl", "1m")
 
 	// Read from environment variables
 	viper.AutomaticEnv()
@@ -58,8 +171,9 @@ func Load() (*Config, error) {
 
 	cfg := &Config{
 		Server: ServerConfig{
-			Port: getEnvOrDefault("SERVER_PORT", viper.GetString("server.port")),
-			Host: getEnvOrDefault("SERVER_HOST", viper.GetString("server.host")),
+			Port:           getEnvOrDefault("SERVER_PORT", viper.GetString("server.port")),
+			Host:           getEnvOrDefault("SERVER_HOST", viper.GetString("server.host")),
+			TrustedProxies: getEnvListOrDefault("SERVER_TRUSTED_PROXIES", viper.GetStringSlice("server.trusted_proxies")),
 		},
 		Database: DatabaseConfig{
 			Host:     getEnvOrDefault("DATABASE_HOST", viper.GetString("database.host")),
@@ -72,6 +186,40 @@ func Load() (*Config, error) {
 		Logger: LoggerConfig{
 			Level: getEnvOrDefault("LOG_LEVEL", viper.GetString("logger.level")),
 		},
+		Vehicles: VehiclesConfig{
+			StaleAfter: getEnvDurationOrDefault("VEHICLES_STALE_AFTER", viper.GetDuration("vehicles.stale_after")),
+		},
+		WebSocket: WebSocketConfig{
+			AllowedOrigins: getEnvListOrDefault("WS_ALLOWED_ORIGINS", viper.GetStringSlice("websocket.allowed_origins")),
+		},
+		Devices: DevicesConfig{
+			TokenTTL: getEnvDurationOrDefault("DEVICE_TOKEN_TTL", viper.GetDuration("devices.token_ttl")),
+		},
+		Login: LoginConfig{
+			MaxAttempts:   getEnvIntOrDefault("LOGIN_MAX_ATTEMPTS", viper.GetInt("login.max_attempts")),
+			IPMaxAttempts: getEnvIntOrDefault("LOGIN_IP_MAX_ATTEMPTS", viper.GetInt("login.ip_max_attempts")),
+			Lockout:       getEnvDurationOrDefault("LOGIN_LOCKOUT", viper.GetDuration("login.lockout")),
+		},
+		Mail: MailConfig{
+			Driver:      getEnvOrDefault("MAIL_DRIVER", viper.GetString("mail.driver")),
+			Dir:         getEnvOrDefault("MAIL_DIR", viper.GetString("mail.dir")),
+			From:        getEnvOrDefault("MAIL_FROM", viper.GetString("mail.from")),
+			LinkBaseURL: getEnvOrDefault("MAIL_LINK_BASE_URL", viper.GetString("mail.link_base_url")),
+		},
+		GTFSRT: GTFSRTConfig{
+			CacheTTL: getEnvDurationOrDefault("GTFSRT_CACHE_TTL", viper.GetDuration("gtfs_rt.cache_ttl")),
+		},
+		ETA: ETAConfig{
+			HistoryWindow: getEnvDurationOrDefault("ETA_HISTORY_WINDOW", viper.GetDuration("eta.history_window")),
+			CacheTTL:      getEnvDurationOrDefault("ETA_CACHE_TTL", viper.GetDuration("eta.cache_ttl")),
+		},
+	}
+
+	if err := viper.UnmarshalKey("ratelimit.policies", &cfg.RateLimit.Policies); err != nil {
+		return nil, err
+	}
+	if err := viper.UnmarshalKey("ratelimit.pre_auth", &cfg.RateLimit.PreAuth); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
@@ -92,3 +240,25 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var out []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	return defaultValue
+}
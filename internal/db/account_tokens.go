@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Purposes of account_tokens rows. A token only redeems for its own purpose.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+// CreateAccountToken stores a new token for the user and invalidates any
+// unused token issued earlier for the same purpose, so only the most recent
+// email works.
+func CreateAccountToken(ctx context.Context, userID, purpose, tokenHash string, expiresAt time.Time) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE account_tokens SET used_at=now()
+		WHERE user_id=$1 AND purpose=$2 AND used_at IS NULL`, userID, purpose); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO account_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1,$2,$3,$4)`, userID, purpose, tokenHash, expiresAt); err != nil {
+		return mapError(err)
+	}
+	return tx.Commit(ctx)
+}
+
+// VerifyEmail redeems a verify_email token and marks the user's email as
+// verified. Returns the user id, or ErrNotFound for unknown, used or expired
+// tokens.
+func VerifyEmail(ctx context.Context, tokenHash string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeAccountToken(ctx, tx, TokenVerifyEmail, tokenHash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE users SET email_verified_at=coalesce(email_verified_at, now()), updated_at=now()
+		WHERE id=$1`, userID); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit(ctx)
+}
+
+// ResetPassword redeems a reset_password token and replaces the user's
+// password hash. Returns the user id, or ErrNotFound for unknown, used or
+// expired tokens.
+func ResetPassword(ctx context.Context, tokenHash, passwordHash string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	userID, err := consumeAccountToken(ctx, tx, TokenResetPassword, tokenHash)
+	if err != nil {
+		return "", err
+	}
+	// Receiving the reset email proves ownership of the address too.
+	if _, err := tx.Exec(ctx, `
+		UPDATE users SET password_hash=$2, email_verified_at=coalesce(email_verified_at, now()), updated_at=now()
+		WHERE id=$1`, userID, passwordHash); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit(ctx)
+}
+
+// consumeAccountToken marks a valid token used and returns its user. The
+// conditional update makes redemption single-use even under concurrency.
+func consumeAccountToken(ctx context.Context, tx pgx.Tx, purpose, tokenHash string) (string, error) {
+	var userID string
+	err := tx.QueryRow(ctx, `
+		UPDATE account_tokens SET used_at=now()
+		WHERE token_hash=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id`, tokenHash, purpose).Scan(&userID)
+	if err != nil {
+		return "", mapError(err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type Bus struct {
+	ID             string
+	RouteID        *string
+	VehicleCode    *string
+	RegistrationNo *string
+	Model          *string
+	Metadata       map[string]interface{}
+	CreatedAt      time.Time
+}
+
+// BusFilter narrows ListBuses; empty fields are ignored.
+type BusFilter struct {
+	RouteID string
+	// Query matches vehicle code or registration number case-insensitively.
+	Query string
+}
+
+const busColumns = `id, route_id, vehicle_code, registration_no, model, COALESCE(metadata, '{}'::jsonb), created_at`
+
+func scanBus(row interface{ Scan(...any) error }) (*Bus, error) {
+	b := &Bus{}
+	if err := row.Scan(&b.ID, &b.RouteID, &b.VehicleCode, &b.RegistrationNo, &b.Model, &b.Metadata, &b.CreatedAt); err != nil {
+		return nil, mapError(err)
+	}
+	return b, nil
+}
+
+func CreateBus(ctx context.Context, b *Bus) (*Bus, error) {
+	row := pool.QueryRow(ctx, `
+		INSERT INTO buses (route_id, vehicle_code, registration_no, model, metadata)
+		VALUES ($1, $2, $3, $4, COALESCE($5, '{}'::jsonb))
+		RETURNING `+busColumns, b.RouteID, b.VehicleCode, b.RegistrationNo, b.Model, b.Metadata)
+	return scanBus(row)
+}
+
+func GetBus(ctx context.Context, id string) (*Bus, error) {
+	return scanBus(pool.QueryRow(ctx, `SELECT `+busColumns+` FROM buses WHERE id = $1`, id))
+}
+
+// GetBusByVehicleCode looks a bus up by its unique vehicle_code.
+func GetBusByVehicleCode(ctx context.Context, code string) (*Bus, error) {
+	return scanBus(pool.QueryRow(ctx, `SELECT `+busColumns+` FROM buses WHERE vehicle_code = $1`, code))
+}
+
+func UpdateBus(ctx context.Context, b *Bus) (*Bus, error) {
+	row := pool.QueryRow(ctx, `
+		UPDATE buses SET route_id = $2, vehicle_code = $3, registration_no = $4, model = $5,
+		       metadata = COALESCE($6, '{}'::jsonb)
+		WHERE id = $1
+		RETURNING `+busColumns, b.ID, b.RouteID, b.VehicleCode, b.RegistrationNo, b.Model, b.Metadata)
+	return scanBus(row)
+}
+
+// DeleteBus removes a bus. It fails with ErrInUse once the bus has recorded
+// positions, which keep their bus.
+func DeleteBus(ctx context.Context, id string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM buses WHERE id = $1`, id)
+	if err != nil {
+		if err = mapError(err); errors.Is(err, ErrInvalidReference) {
+			return ErrInUse
+		}
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListBuses returns one page of buses ordered by vehicle code, and the total
+// number of matching buses.
+func ListBuses(ctx context.Context, f BusFilter, opts ListOptions) ([]Bus, int, error) {
+	const where = `
+		WHERE ($1 = '' OR route_id::text = $1)
+		  AND ($2 = '' OR vehicle_code ILIKE '%' || $2 || '%' OR registration_no ILIKE '%' || $2 || '%')`
+	var total int
+	if err := pool.QueryRow(ctx, `SELECT count(*) FROM buses`+where, f.RouteID, f.Query).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := pool.Query(ctx, `SELECT `+busColumns+` FROM buses`+where+`
+		ORDER BY vehicle_code NULLS LAST, id
+		LIMIT $3 OFFSET $4`, f.RouteID, f.Query, opts.Limit, opts.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var out []Bus
+	for rows.Next() {
+		b, err := scanBus(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, *b)
+	}
+	return out, total, rows.Err()
+}
@@ -33,8 +33,21 @@ type User struct {
 	ID           string
 	Name         string
 	Email        string
+	Phone        *string
 	PasswordHash string
 	Role         string
+	// EmailVerifiedAt is nil until the user follows a verification link.
+	EmailVerifiedAt *time.Time
+}
+
+const userColumns = `id,name,email,phone,password_hash,role,email_verified_at`
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	u := &User{}
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Phone, &u.PasswordHash, &u.Role, &u.EmailVerifiedAt); err != nil {
+		return nil, mapError(err)
+	}
+	return u, nil
 }
 
 func InsertUser(ctx context.Context, id, name, email, passwordHash string) error {
@@ -43,12 +56,7 @@ func InsertUser(ctx context.Context, id, name, email, passwordHash string) error
 }
 
 func FindUserByEmail(ctx context.Context, email string) (*User, error) {
-	row := pool.QueryRow(ctx, `SELECT id,name,email,password_hash,role FROM users WHERE email=$1`, email)
-	u := &User{}
-	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Role); err != nil {
-		return nil, err
-	}
-	return u, nil
+	return scanUser(pool.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE email=$1`, email))
 }
 func Ping(ctx context.Context) error {
 	if pool == nil {
@@ -59,32 +67,39 @@ func Ping(ctx context.Context) error {
 
 // GetUserByID returns user by id
 func GetUserByID(ctx context.Context, id string) (*User, error) {
-	row := pool.QueryRow(ctx, `SELECT id,name,email,password_hash,role FROM users WHERE id=$1`, id)
-	u := &User{}
-	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.Role); err != nil {
-		return nil, err
-	}
-	return u, nil
+	return scanUser(pool.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id=$1`, id))
 }
 
-// StoreRefreshToken stores a refresh token hash for a user
-func StoreRefreshToken(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
-	_, err := pool.Exec(ctx, `INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1,$2,$3)`, userID, tokenHash, expiresAt)
-	return err
+// UpdateUserRole changes a user's role and returns the updated user.
+func UpdateUserRole(ctx context.Context, id, role string) (*User, error) {
+	return scanUser(pool.QueryRow(ctx, `UPDATE users SET role=$2, updated_at=now() WHERE id=$1 RETURNING `+userColumns, id, role))
+}
+
+// UpdateUserProfile sets the user-editable profile fields.
+func UpdateUserProfile(ctx context.Context, id, name string, phone *string) (*User, error) {
+	return scanUser(pool.QueryRow(ctx, `UPDATE users SET name=$2, phone=$3, updated_at=now() WHERE id=$1 RETURNING `+userColumns, id, name, phone))
 }
 
-// GetUserIDByRefreshHash returns (userID, ok, error)
-func GetUserIDByRefreshHash(ctx context.Context, tokenHash string) (string, bool, error) {
-	row := pool.QueryRow(ctx, `SELECT user_id FROM refresh_tokens WHERE token_hash=$1 AND revoked=false AND expires_at > now() LIMIT 1`, tokenHash)
-	var userID string
-	if err := row.Scan(&userID); err != nil {
-		return "", false, err
+// UpdateUserPassword replaces a user's password hash.
+func UpdateUserPassword(ctx context.Context, id, passwordHash string) error {
+	tag, err := pool.Exec(ctx, `UPDATE users SET password_hash=$2, updated_at=now() WHERE id=$1`, id, passwordHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
 	}
-	return userID, true, nil
+	return nil
 }
 
-// RevokeRefreshTokenByHash marks token revoked
-func RevokeRefreshTokenByHash(ctx context.Context, tokenHash string) error {
-	_, err := pool.Exec(ctx, `UPDATE refresh_tokens SET revoked=true WHERE token_hash=$1`, tokenHash)
-	return err
+// DeleteUser deletes a user; their refresh tokens go with them (ON DELETE CASCADE).
+func DeleteUser(ctx context.Context, id string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM users WHERE id=$1`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	// ErrNotFound is returned when a row addressed by id does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned on a unique constraint violation.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidReference is returned when a foreign key points nowhere.
+	ErrInvalidReference = errors.New("invalid reference")
+	// ErrInvalidValue is returned on a check constraint violation.
+	ErrInvalidValue = errors.New("invalid value")
+	// ErrInUse is returned when a row cannot be deleted because other rows
+	// still reference it.
+	ErrInUse = errors.New("in use")
+)
+
+// mapError translates driver errors into the sentinel errors above so
+// handlers can pick a status code without depending on pgx.
+func mapError(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505":
+			return ErrConflict
+		case "23503":
+			return ErrInvalidReference
+		case "23514":
+			return ErrInvalidValue
+		}
+	}
+	return err
+}
+
+// ListOptions pages list queries.
+type ListOptions struct {
+	Limit  int
+	Offset int
+}
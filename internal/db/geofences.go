@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Geofence kinds.
+const (
+	GeofencePolygon = "polygon"
+	GeofenceCircle  = "circle"
+)
+
+type Geofence struct {
+	ID   string
+	Name string
+	Kind string
+	// Polygon holds the rings of a polygon fence as GeoJSON coordinates,
+	// [lon, lat] pairs with the exterior ring first.
+	Polygon [][][2]float64
+	// Latitude, Longitude and RadiusMeters describe a circle fence.
+	Latitude     *float64
+	Longitude    *float64
+	RadiusMeters *float64
+	DwellSeconds *int
+	Active       bool
+	Metadata     map[string]interface{}
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// GeofenceFilter narrows ListGeofences; empty fields are ignored.
+type GeofenceFilter struct {
+	// Query matches the name case-insensitively.
+	Query  string
+	Active *bool
+}
+
+const geofenceColumns = `id, name, kind,
+	CASE WHEN kind = 'polygon' THEN ST_AsGeoJSON(geom) END,
+	CASE WHEN kind = 'circle' THEN ST_Y(geom) END,
+	CASE WHEN kind = 'circle' THEN ST_X(geom) END,
+	radius_m, dwell_seconds, active, COALESCE(metadata, '{}'::jsonb), created_at, updated_at`
+
+// geofenceGeom builds geom from $2 (kind), $3 (GeoJSON), $4 (lat) and $5 (lon).
+const geofenceGeom = `CASE WHEN $2 = 'circle'
+	THEN ST_SetSRID(ST_MakePoint($5::float8, $4::float8), 4326)
+	ELSE ST_SetSRID(ST_GeomFromGeoJSON($3::text), 4326) END`
+
+func scanGeofence(row interface{ Scan(...any) error }) (*Geofence, error) {
+	g := &Geofence{}
+	var geojson *string
+	if err := row.Scan(&g.ID, &g.Name, &g.Kind, &geojson, &g.Latitude, &g.Longitude,
+		&g.RadiusMeters, &g.DwellSeconds, &g.Active, &g.Metadata, &g.CreatedAt, &g.UpdatedAt); err != nil {
+		return nil, mapError(err)
+	}
+	if geojson != nil {
+		var geom struct {
+			Coordinates [][][2]float64 `json:"coordinates"`
+		}
+		if err := json.Unmarshal([]byte(*geojson), &geom); err != nil {
+			return nil, err
+		}
+		g.Polygon = geom.Coordinates
+	}
+	return g, nil
+}
+
+// polygonGeoJSON encodes the polygon of g for ST_GeomFromGeoJSON, or nil for
+// circles.
+func polygonGeoJSON(g *Geofence) *string {
+	if g.Kind != GeofencePolygon {
+		return nil
+	}
+	b, _ := json.Marshal(map[string]interface{}{"type": "Polygon", "coordinates": g.Polygon})
+	s := string(b)
+	return &s
+}
+
+func CreateGeofence(ctx context.Context, g *Geofence) (*Geofence, error) {
+	row := pool.QueryRow(ctx, `
+		INSERT INTO geofences (name, kind, geom, radius_m, dwell_seconds, active, metadata)
+		VALUES ($1, $2, `+geofenceGeom+`, $6, $7, $8, COALESCE($9, '{}'::jsonb))
+		RETURNING `+geofenceColumns,
+		g.Name, g.Kind, polygonGeoJSON(g), g.Latitude, g.Longitude, g.RadiusMeters, g.DwellSeconds, g.Active, g.Metadata)
+	return scanGeofence(row)
+}
+
+func GetGeofence(ctx context.Context, id string) (*Geofence, error) {
+	return scanGeofence(pool.QueryRow(ctx, `SELECT `+geofenceColumns+` FROM geofences WHERE id = $1`, id))
+}
+
+func UpdateGeofence(ctx context.Context, g *Geofence) (*Geofence, error) {
+	row := pool.QueryRow(ctx, `
+		UPDATE geofences SET name = $1, kind = $2, geom = `+geofenceGeom+`, radius_m = $6,
+			dwell_seconds = $7, active = $8, metadata = COALESCE($9, '{}'::jsonb), updated_at = now()
+		WHERE id = $10
+		RETURNING `+geofenceColumns,
+		g.Name, g.Kind, polygonGeoJSON(g), g.Latitude, g.Longitude, g.RadiusMeters, g.DwellSeconds, g.Active, g.Metadata, g.ID)
+	return scanGeofence(row)
+}
+
+// DeleteGeofence removes a geofence and its events.
+func DeleteGeofence(ctx context.Context, id string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM geofences WHERE id = $1`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListGeofences returns one page of geofences ordered by name, and the total
+// number of matching geofences.
+func ListGeofences(ctx context.Context, f GeofenceFilter, opts ListOptions) ([]Geofence, int, error) {
+	const where = `
+		WHERE ($1 = '' OR name ILIKE '%' || $1 || '%')
+		  AND ($2::boolean IS NULL OR active = $2)`
+	var total int
+	if err := pool.QueryRow(ctx, `SELECT count(*) FROM geofences`+where, f.Query, f.Active).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := pool.Query(ctx, `SELECT `+geofenceColumns+` FROM geofences`+where+`
+		ORDER BY name, id
+		LIMIT $3 OFFSET $4`, f.Query, f.Active, opts.Limit, opts.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out, err := collectGeofences(rows)
+	return out, total, err
+}
+
+// ListActiveGeofences returns every active geofence.
+func ListActiveGeofences(ctx context.Context) ([]Geofence, error) {
+	rows, err := pool.Query(ctx, `SELECT `+geofenceColumns+` FROM geofences WHERE active`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return collectGeofences(rows)
+}
+
+func collectGeofences(rows pgx.Rows) ([]Geofence, error) {
+	var out []Geofence
+	for rows.Next() {
+		g, err := scanGeofence(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *g)
+	}
+	return out, rows.Err()
+}
+
+// Geofence event kinds.
+const (
+	GeofenceEnter = "enter"
+	GeofenceExit  = "exit"
+	GeofenceDwell = "dwell"
+)
+
+// GeofenceEvent is a bus entering, leaving or dwelling in a geofence at the
+// fix Lat/Lon.
+type GeofenceEvent struct {
+	ID         int64
+	GeofenceID string
+	BusID      string
+	Event      string
+	Ts         time.Time
+	Lat        float64
+	Lon        float64
+	// DwellSeconds is the time spent inside, set on exit and dwell events.
+	DwellSeconds *int
+}
+
+// InsertGeofenceEvents writes events with one multi-row INSERT.
+func InsertGeofenceEvents(ctx context.Context, events []GeofenceEvent) error {
+	n := len(events)
+	fenceIDs, busIDs, kinds := make([]string, n), make([]string, n), make([]string, n)
+	ts, lats, lons, dwells := make([]time.Time, n), make([]float64, n), make([]float64, n), make([]*int32, n)
+	for i, e := range events {
+		fenceIDs[i], busIDs[i], kinds[i], ts[i], lats[i], lons[i] = e.GeofenceID, e.BusID, e.Event, e.Ts, e.Lat, e.Lon
+		if e.DwellSeconds != nil {
+			d := int32(*e.DwellSeconds)
+			dwells[i] = &d
+		}
+	}
+	_, err := pool.Exec(ctx, `
+		INSERT INTO geofence_events (geofence_id, bus_id, event, ts, lat, lon, dwell_seconds)
+		SELECT * FROM unnest($1::uuid[], $2::uuid[], $3::text[], $4::timestamptz[], $5::float8[], $6::float8[], $7::int[])
+	`, fenceIDs, busIDs, kinds, ts, lats, lons, dwells)
+	return err
+}
+
+// ListGeofenceEvents returns up to limit events of a geofence in [from, to),
+// newest first. busID narrows them to one bus when set.
+func ListGeofenceEvents(ctx context.Context, geofenceID, busID string, from, to time.Time, limit int) ([]GeofenceEvent, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, geofence_id, bus_id, event, ts, lat, lon, dwell_seconds
+		FROM geofence_events
+		WHERE geofence_id = $1 AND ($2 = '' OR bus_id::text = $2) AND ts >= $3 AND ts < $4
+		ORDER BY ts DESC, id DESC
+		LIMIT $5`, geofenceID, busID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []GeofenceEvent
+	for rows.Next() {
+		var e GeofenceEvent
+		if err := rows.Scan(&e.ID, &e.GeofenceID, &e.BusID, &e.Event, &e.Ts, &e.Lat, &e.Lon, &e.DwellSeconds); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,335 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/gtfs"
+	"github.com/jackc/pgx/v5"
+)
+
+// stopTimesChunk bounds the rows sent per stop_times INSERT.
+const stopTimesChunk = 20000
+
+// GTFSImportStats counts what an import wrote and what it removed because it
+// is no longer in the feed.
+type GTFSImportStats struct {
+	Agencies      int
+	Routes        int
+	Stops         int
+	Services      int
+	Shapes        int
+	Trips         int
+	StopTimes     int
+	RemovedRoutes int
+	RemovedStops  int
+	RemovedTrips  int
+}
+
+// ImportGTFS replaces the imported part of the schedule with feed, in one
+// transaction. Routes, stops and trips are upserted by their GTFS id so their
+// uuids survive re-imports and buses stay assigned to their routes; imported
+// rows missing from the new feed are deleted. Rows created through the API
+// (gtfs_id NULL) are left alone. Each route gets its own stop rows, ordered by
+// gtfs.Feed.RouteStops.
+func ImportGTFS(ctx context.Context, feed *gtfs.Feed) (*GTFSImportStats, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	st := &GTFSImportStats{}
+	steps := []func(context.Context, pgx.Tx, *gtfs.Feed, *GTFSImportStats, *importedIDs) error{
+		importAgencies, importRoutes, importStops, importCalendar, importShapes, importTrips, importStopTimes,
+	}
+	ids := &importedIDs{routes: map[string]string{}, stops: map[[2]string]string{}, trips: map[string]string{}}
+	for _, step := range steps {
+		if err := step(ctx, tx, feed, st, ids); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// importedIDs maps GTFS ids to the uuids of the rows written so far.
+type importedIDs struct {
+	routes map[string]string
+	// stops is keyed by route uuid and GTFS stop id
+	stops map[[2]string]string
+	trips map[string]string
+}
+
+func importAgencies(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, _ *importedIDs) error {
+	n := len(feed.Agencies)
+	ids, names, urls, tzs := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	langs, phones := make([]*string, n), make([]*string, n)
+	for i, a := range feed.Agencies {
+		ids[i], names[i], urls[i], tzs[i] = a.ID, a.Name, a.URL, a.Timezone
+		langs[i], phones[i] = nullable(a.Lang), nullable(a.Phone)
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO agencies (gtfs_id, name, url, timezone, lang, phone)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[])
+		ON CONFLICT (gtfs_id) DO UPDATE SET name = excluded.name, url = excluded.url,
+		       timezone = excluded.timezone, lang = excluded.lang, phone = excluded.phone`,
+		ids, names, urls, tzs, langs, phones)
+	if err != nil {
+		return err
+	}
+	st.Agencies = int(tag.RowsAffected())
+	_, err = tx.Exec(ctx, `DELETE FROM agencies WHERE gtfs_id <> ALL($1::text[])`, ids)
+	return err
+}
+
+func importRoutes(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, ids *importedIDs) error {
+	n := len(feed.Routes)
+	gtfsIDs, names, numbers, metas := make([]string, n), make([]string, n), make([]*string, n), make([]string, n)
+	for i := range feed.Routes {
+		r := &feed.Routes[i]
+		gtfsIDs[i], names[i], numbers[i] = r.ID, r.DisplayName(), nullable(r.ShortName)
+		meta := map[string]interface{}{"routeType": r.Type}
+		for k, v := range map[string]string{"agencyId": r.AgencyID, "longName": r.LongName, "color": r.Color, "textColor": r.TextColor} {
+			if v != "" {
+				meta[k] = v
+			}
+		}
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		metas[i] = string(b)
+	}
+	// Metadata is merged so keys added through the API survive re-imports.
+	rows, err := tx.Query(ctx, `
+		INSERT INTO routes (gtfs_id, name, number, metadata)
+		SELECT u.gtfs_id, u.name, u.number, u.metadata::jsonb
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::text[]) AS u(gtfs_id, name, number, metadata)
+		ON CONFLICT (gtfs_id) DO UPDATE SET name = excluded.name, number = excluded.number,
+		       metadata = COALESCE(routes.metadata, '{}'::jsonb) || excluded.metadata
+		RETURNING gtfs_id, id`, gtfsIDs, names, numbers, metas)
+	if err != nil {
+		return err
+	}
+	if err := collectIDs(rows, ids.routes); err != nil {
+		return err
+	}
+	st.Routes = len(ids.routes)
+	tag, err := tx.Exec(ctx, `DELETE FROM routes WHERE gtfs_id IS NOT NULL AND gtfs_id <> ALL($1::text[])`, gtfsIDs)
+	if err != nil {
+		return err
+	}
+	st.RemovedRoutes = int(tag.RowsAffected())
+	return nil
+}
+
+func importStops(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, ids *importedIDs) error {
+	byID := make(map[string]*gtfs.Stop, len(feed.Stops))
+	for i := range feed.Stops {
+		byID[feed.Stops[i].ID] = &feed.Stops[i]
+	}
+	var routeIDs, gtfsIDs, names []string
+	var lats, lons []float64
+	var seqs []int32
+	for routeGTFS, order := range feed.RouteStops() {
+		routeID := ids.routes[routeGTFS]
+		for i, stopID := range order {
+			s := byID[stopID]
+			routeIDs = append(routeIDs, routeID)
+			gtfsIDs = append(gtfsIDs, s.ID)
+			names = append(names, s.Name)
+			lats = append(lats, s.Lat)
+			lons = append(lons, s.Lon)
+			seqs = append(seqs, int32(i+1))
+		}
+	}
+	rows, err := tx.Query(ctx, `
+		INSERT INTO stops (route_id, gtfs_id, name, latitude, longitude, seq)
+		SELECT * FROM unnest($1::uuid[], $2::text[], $3::text[], $4::double precision[], $5::double precision[], $6::int[])
+		ON CONFLICT (route_id, gtfs_id) DO UPDATE SET name = excluded.name,
+		       latitude = excluded.latitude, longitude = excluded.longitude, seq = excluded.seq
+		RETURNING route_id, gtfs_id, id`, routeIDs, gtfsIDs, names, lats, lons, seqs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	kept := make([]string, 0, len(gtfsIDs))
+	for rows.Next() {
+		var routeID, gtfsID, id string
+		if err := rows.Scan(&routeID, &gtfsID, &id); err != nil {
+			return err
+		}
+		ids.stops[[2]string{routeID, gtfsID}] = id
+		kept = append(kept, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	st.Stops = len(kept)
+	tag, err := tx.Exec(ctx, `DELETE FROM stops WHERE gtfs_id IS NOT NULL AND id <> ALL($1::uuid[])`, kept)
+	if err != nil {
+		return err
+	}
+	st.RemovedStops = int(tag.RowsAffected())
+	return nil
+}
+
+func importCalendar(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, _ *importedIDs) error {
+	n := len(feed.Calendar)
+	ids := make([]string, n)
+	var days [7][]bool
+	for d := range days {
+		days[d] = make([]bool, n)
+	}
+	starts, ends := make([]time.Time, n), make([]time.Time, n)
+	for i, s := range feed.Calendar {
+		ids[i] = s.ID
+		for d := range days {
+			days[d][i] = s.Days[d]
+		}
+		starts[i], ends[i] = s.Start, s.End
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO calendar (service_id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, start_date, end_date)
+		SELECT * FROM unnest($1::text[], $2::bool[], $3::bool[], $4::bool[], $5::bool[], $6::bool[], $7::bool[], $8::bool[], $9::date[], $10::date[])
+		ON CONFLICT (service_id) DO UPDATE SET monday = excluded.monday, tuesday = excluded.tuesday,
+		       wednesday = excluded.wednesday, thursday = excluded.thursday, friday = excluded.friday,
+		       saturday = excluded.saturday, sunday = excluded.sunday,
+		       start_date = excluded.start_date, end_date = excluded.end_date`,
+		ids, days[0], days[1], days[2], days[3], days[4], days[5], days[6], starts, ends)
+	if err != nil {
+		return err
+	}
+	st.Services = int(tag.RowsAffected())
+	_, err = tx.Exec(ctx, `DELETE FROM calendar WHERE service_id <> ALL($1::text[])`, ids)
+	return err
+}
+
+func importShapes(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, _ *importedIDs) error {
+	ids := make([]string, len(feed.Shapes))
+	batch := &pgx.Batch{}
+	for i, s := range feed.Shapes {
+		ids[i] = s.ID
+		lats, lons := make([]float64, len(s.Points)), make([]float64, len(s.Points))
+		for j, p := range s.Points {
+			lats[j], lons[j] = p.Lat, p.Lon
+		}
+		batch.Queue(`
+			INSERT INTO shapes (gtfs_id, geom)
+			SELECT $1, ST_SetSRID(ST_MakeLine(ST_MakePoint(p.lon, p.lat) ORDER BY p.n), 4326)
+			FROM unnest($2::double precision[], $3::double precision[]) WITH ORDINALITY AS p(lat, lon, n)
+			ON CONFLICT (gtfs_id) DO UPDATE SET geom = excluded.geom`, s.ID, lats, lons)
+	}
+	if batch.Len() > 0 {
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return err
+		}
+	}
+	st.Shapes = len(ids)
+	_, err := tx.Exec(ctx, `DELETE FROM shapes WHERE gtfs_id <> ALL($1::text[])`, ids)
+	return err
+}
+
+func importTrips(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, ids *importedIDs) error {
+	n := len(feed.Trips)
+	gtfsIDs, routeIDs, services := make([]string, n), make([]string, n), make([]string, n)
+	headsigns, blocks, shapes := make([]*string, n), make([]*string, n), make([]*string, n)
+	directions := make([]*int32, n)
+	for i, t := range feed.Trips {
+		gtfsIDs[i], routeIDs[i], services[i] = t.ID, ids.routes[t.RouteID], t.ServiceID
+		headsigns[i], blocks[i], shapes[i] = nullable(t.Headsign), nullable(t.BlockID), nullable(t.ShapeID)
+		if t.DirectionID != nil {
+			d := int32(*t.DirectionID)
+			directions[i] = &d
+		}
+	}
+	rows, err := tx.Query(ctx, `
+		INSERT INTO trips (gtfs_id, route_id, service_id, headsign, direction_id, block_id, shape_id)
+		SELECT * FROM unnest($1::text[], $2::uuid[], $3::text[], $4::text[], $5::smallint[], $6::text[], $7::text[])
+		ON CONFLICT (gtfs_id) DO UPDATE SET route_id = excluded.route_id, service_id = excluded.service_id,
+		       headsign = excluded.headsign, direction_id = excluded.direction_id,
+		       block_id = excluded.block_id, shape_id = excluded.shape_id
+		RETURNING gtfs_id, id`, gtfsIDs, routeIDs, services, headsigns, directions, blocks, shapes)
+	if err != nil {
+		return err
+	}
+	if err := collectIDs(rows, ids.trips); err != nil {
+		return err
+	}
+	st.Trips = len(ids.trips)
+	tag, err := tx.Exec(ctx, `DELETE FROM trips WHERE gtfs_id <> ALL($1::text[])`, gtfsIDs)
+	if err != nil {
+		return err
+	}
+	st.RemovedTrips = int(tag.RowsAffected())
+	return nil
+}
+
+// importStopTimes rewrites the stop times of every imported trip.
+func importStopTimes(ctx context.Context, tx pgx.Tx, feed *gtfs.Feed, st *GTFSImportStats, ids *importedIDs) error {
+	tripIDs := make([]string, 0, len(ids.trips))
+	for _, id := range ids.trips {
+		tripIDs = append(tripIDs, id)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM stop_times WHERE trip_id = ANY($1::uuid[])`, tripIDs); err != nil {
+		return err
+	}
+	routeOf := make(map[string]string, len(feed.Trips))
+	for _, t := range feed.Trips {
+		routeOf[t.ID] = ids.routes[t.RouteID]
+	}
+
+	for start := 0; start < len(feed.StopTimes); start += stopTimesChunk {
+		chunk := feed.StopTimes[start:min(start+stopTimesChunk, len(feed.StopTimes))]
+		n := len(chunk)
+		trips, stops := make([]string, n), make([]string, n)
+		seqs := make([]int32, n)
+		arrivals, departures := make([]*int32, n), make([]*int32, n)
+		for i, s := range chunk {
+			trips[i] = ids.trips[s.TripID]
+			stops[i] = ids.stops[[2]string{routeOf[s.TripID], s.StopID}]
+			seqs[i] = int32(s.Sequence)
+			arrivals[i], departures[i] = secs(s.Arrival), secs(s.Departure)
+		}
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO stop_times (trip_id, stop_sequence, stop_id, arrival_secs, departure_secs)
+			SELECT * FROM unnest($1::uuid[], $2::int[], $3::uuid[], $4::int[], $5::int[])`,
+			trips, seqs, stops, arrivals, departures)
+		if err != nil {
+			return err
+		}
+		st.StopTimes += int(tag.RowsAffected())
+	}
+	return nil
+}
+
+func collectIDs(rows pgx.Rows, into map[string]string) error {
+	defer rows.Close()
+	for rows.Next() {
+		var gtfsID, id string
+		if err := rows.Scan(&gtfsID, &id); err != nil {
+			return err
+		}
+		into[gtfsID] = id
+	}
+	return rows.Err()
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func secs(v *int) *int32 {
+	if v == nil {
+		return nil
+	}
+	s := int32(*v)
+	return &s
+}
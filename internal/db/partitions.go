@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Partitions are named by create_positions_partition (migration 0003).
+var partitionName = regexp.MustCompile(`^positions_(\d{4})_(\d{2})$`)
+
+// PositionPartition is a monthly partition of the positions table.
+type PositionPartition struct {
+	Name         string
+	From         time.Time
+	To           time.Time
+	RowsEstimate int64
+	SizeBytes    int64
+}
+
+// ListPositionPartitions returns the monthly partitions attached to positions,
+// oldest first. Row counts are planner estimates from pg_class.
+func ListPositionPartitions(ctx context.Context) ([]PositionPartition, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("no db pool initialized")
+	}
+	rows, err := pool.Query(ctx, `
+		SELECT c.relname, GREATEST(c.reltuples, 0)::bigint, pg_total_relation_size(c.oid)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'positions'
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PositionPartition
+	for rows.Next() {
+		var p PositionPartition
+		if err := rows.Scan(&p.Name, &p.RowsEstimate, &p.SizeBytes); err != nil {
+			return nil, err
+		}
+		m := partitionName.FindStringSubmatch(p.Name)
+		if m == nil {
+			continue
+		}
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		p.From = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		p.To = p.From.AddDate(0, 1, 0)
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// EnsurePositionPartitions creates the partitions for the current month and
+// the monthsAhead months after it. Existing partitions are left untouched.
+func EnsurePositionPartitions(ctx context.Context, now time.Time, monthsAhead int) error {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= monthsAhead; i++ {
+		m := start.AddDate(0, i, 0)
+		if _, err := pool.Exec(ctx, `SELECT create_positions_partition($1, $2)`, m.Year(), int(m.Month())); err != nil {
+			return fmt.Errorf("create partition %d-%02d: %w", m.Year(), m.Month(), err)
+		}
+	}
+	return nil
+}
+
+// DetachPositionPartition detaches a partition from positions but keeps the
+// table, e.g. for archiving with pg_dump before it is dropped by hand.
+func DetachPositionPartition(ctx context.Context, name string) error {
+	_, err := pool.Exec(ctx, `ALTER TABLE positions DETACH PARTITION `+pgx.Identifier{name}.Sanitize())
+	return err
+}
+
+// DropPositionPartition drops a partition and its data.
+func DropPositionPartition(ctx context.Context, name string) error {
+	_, err := pool.Exec(ctx, `DROP TABLE `+pgx.Identifier{name}.Sanitize())
+	return err
+}
+
+// PartitionsAhead counts the consecutive monthly partitions after the one
+// containing now. 0 means inserts fail at the next month boundary.
+func PartitionsAhead(parts []PositionPartition, now time.Time) int {
+	have := make(map[time.Time]bool, len(parts))
+	for _, p := range parts {
+		have[p.From] = true
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	n := 0
+	for have[month.AddDate(0, n+1, 0)] {
+		n++
+	}
+	return n
+}
@@ -2,13 +2,152 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 )
 
-func InsertPosition(ctx context.Context, busId string, ts int64, lat, lon, speed float64, raw map[string]interface{}) error {
+// PositionRow is a fix to be written to the positions table.
+type PositionRow struct {
+	BusID   string
+	RouteID *string
+	Ts      int64
+	Lat     float64
+	Lon     float64
+	Speed   float64
+	Heading float64
+	Raw     map[string]interface{}
+}
+
+func InsertPosition(ctx context.Context, p PositionRow) error {
 	// Use ST_SetSRID(ST_MakePoint(lon, lat),4326)
 	_, err := pool.Exec(ctx, `
 		INSERT INTO positions (bus_id, route_id, ts, speed_kph, heading, geom, raw)
 		VALUES ($1,$2,to_timestamp($3),$4,$5,ST_SetSRID(ST_MakePoint($6,$7),4326),$8)
-	`, busId, nil, ts, speed, nil, lon, lat, raw)
+	`, p.BusID, p.RouteID, p.Ts, p.Speed, p.Heading, p.Lon, p.Lat, p.Raw)
 	return err
 }
+
+// InsertPositions writes all rows with one multi-row INSERT in a single
+// transaction, so either every row is stored or none is. The geometry column
+// has no pgx codec, which rules out COPY; unnest keeps it to one statement.
+func InsertPositions(ctx context.Context, rows []PositionRow) error {
+	n := len(rows)
+	busIDs := make([]string, n)
+	routeIDs := make([]*string, n)
+	ts := make([]float64, n)
+	lats := make([]float64, n)
+	lons := make([]float64, n)
+	speeds := make([]float64, n)
+	headings := make([]float64, n)
+	raws := make([]string, n)
+	for i, p := range rows {
+		busIDs[i] = p.BusID
+		routeIDs[i] = p.RouteID
+		ts[i] = float64(p.Ts)
+		lats[i] = p.Lat
+		lons[i] = p.Lon
+		speeds[i] = p.Speed
+		headings[i] = p.Heading
+		b, err := json.Marshal(p.Raw)
+		if err != nil {
+			return err
+		}
+		raws[i] = string(b)
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO positions (bus_id, route_id, ts, speed_kph, heading, geom, raw)
+		SELECT u.bus_id, u.route_id, to_timestamp(u.ts), u.speed, u.heading,
+		       ST_SetSRID(ST_MakePoint(u.lon, u.lat),4326), u.raw::jsonb
+		FROM unnest($1::uuid[], $2::uuid[], $3::double precision[], $4::double precision[], $5::double precision[],
+		            $6::double precision[], $7::double precision[], $8::text[])
+		     AS u(bus_id, route_id, ts, lat, lon, speed, heading, raw)
+	`, busIDs, routeIDs, ts, lats, lons, speeds, headings, raws)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Position is a stored fix read back from the positions table.
+type Position struct {
+	ID       int64
+	BusID    string
+	RouteID  *string
+	Ts       time.Time
+	SpeedKph *float64
+	Heading  *float64
+	Lat      float64
+	Lon      float64
+}
+
+// PositionCursor is the keyset position after which the next page starts.
+// ts alone is not unique per bus, so id breaks ties.
+type PositionCursor struct {
+	Ts time.Time
+	ID int64
+}
+
+// ListPositions returns up to limit fixes for a bus in [from, to) ordered by
+// (ts, id) ascending, starting after cursor when one is given. It is served by
+// idx_positions_bus_ts and lets Postgres prune partitions outside the range.
+func ListPositions(ctx context.Context, busID string, from, to time.Time, cursor *PositionCursor, limit int) ([]Position, error) {
+	args := []interface{}{busID, from, to, limit}
+	keyset := ""
+	if cursor != nil {
+		keyset = "AND (ts, id) > ($5, $6)"
+		args = append(args, cursor.Ts, cursor.ID)
+	}
+	rows, err := pool.Query(ctx, `
+		SELECT id, bus_id, route_id, ts, speed_kph, heading, ST_Y(geom), ST_X(geom)
+		FROM positions
+		WHERE bus_id = $1 AND ts >= $2 AND ts < $3 `+keyset+`
+		ORDER BY ts, id
+		LIMIT $4
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Position
+	for rows.Next() {
+		var p Position
+		if err := rows.Scan(&p.ID, &p.BusID, &p.RouteID, &p.Ts, &p.SpeedKph, &p.Heading, &p.Lat, &p.Lon); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// ListRoutePositions returns the fixes recorded on routeID since since by any
+// of busIDs, ordered by ts. Going through the buses lets idx_positions_bus_ts
+// serve it; positions has no route index.
+func ListRoutePositions(ctx context.Context, routeID string, busIDs []string, since time.Time) ([]Position, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, bus_id, route_id, ts, speed_kph, heading, ST_Y(geom), ST_X(geom)
+		FROM positions
+		WHERE bus_id = ANY($1::uuid[]) AND ts >= $2 AND route_id = $3
+		ORDER BY ts, id
+	`, busIDs, since, routeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Position
+	for rows.Next() {
+		var p Position
+		if err := rows.Scan(&p.ID, &p.BusID, &p.RouteID, &p.Ts, &p.SpeedKph, &p.Heading, &p.Lat, &p.Lon); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
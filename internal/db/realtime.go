@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// VehicleFix is a live position to match against the imported schedule.
+// Day is the local calendar date of the fix in the feed timezone (as a UTC
+// midnight); Secs and PrevSecs are the fix time in seconds after the start
+// of that service day and of the one before, for trips running past midnight.
+type VehicleFix struct {
+	BusID    string
+	Lat      float64
+	Lon      float64
+	Day      time.Time
+	Secs     int
+	PrevSecs int
+}
+
+// VehicleTrip is a bus together with the scheduled trip it is most likely
+// running. The trip fields are empty when no trip matched.
+type VehicleTrip struct {
+	BusID          string
+	VehicleCode    *string
+	RegistrationNo *string
+	// RouteGTFSID is nil when the bus has no route or its route was not
+	// imported from GTFS.
+	RouteGTFSID *string
+
+	TripGTFSID  *string
+	DirectionID *int
+	ServiceDate *time.Time
+	// StopGTFSID and StopSequence are the trip's call at the stop nearest to
+	// the bus; StopDistance is how far the bus is from it in meters.
+	StopGTFSID   *string
+	StopSequence *int
+	StopDistance *float64
+	// Delay is seconds behind schedule at that stop, negative when early.
+	Delay *int
+}
+
+// MatchVehicleTrips looks up the buses of fixes and guesses which trip each
+// one is running: the trip of the bus's route, active on the service day,
+// whose scheduled time at the route stop nearest to the bus is closest to the
+// fix time and no more than window away. Buses that are not registered are
+// left out.
+func MatchVehicleTrips(ctx context.Context, fixes []VehicleFix, window time.Duration) ([]VehicleTrip, error) {
+	n := len(fixes)
+	busIDs, lats, lons, days, secs, prevSecs := make([]string, n), make([]float64, n), make([]float64, n), make([]time.Time, n), make([]int32, n), make([]int32, n)
+	for i, f := range fixes {
+		busIDs[i], lats[i], lons[i], days[i], secs[i], prevSecs[i] = f.BusID, f.Lat, f.Lon, f.Day, int32(f.Secs), int32(f.PrevSecs)
+	}
+	rows, err := pool.Query(ctx, `
+		WITH v AS (
+			SELECT * FROM unnest($1::uuid[], $2::float8[], $3::float8[], $4::date[], $5::int[], $6::int[])
+				AS v(bus_id, lat, lon, day, secs, prev_secs)
+		), near AS (
+			SELECT v.*, b.route_id, s.id AS stop_id, s.gtfs_id AS stop_gtfs_id,
+			       ST_Distance(s.geom::geography, ST_SetSRID(ST_MakePoint(v.lon, v.lat), 4326)::geography) AS dist
+			FROM v
+			JOIN buses b ON b.id = v.bus_id
+			CROSS JOIN LATERAL (
+				SELECT id, gtfs_id, geom FROM stops
+				WHERE route_id = b.route_id AND gtfs_id IS NOT NULL
+				ORDER BY geom <-> ST_SetSRID(ST_MakePoint(v.lon, v.lat), 4326)
+				LIMIT 1
+			) s
+		), matched AS (
+			SELECT DISTINCT ON (n.bus_id)
+			       n.bus_id, t.gtfs_id, t.direction_id, d.day, n.stop_gtfs_id, st.stop_sequence, n.dist,
+			       d.secs - COALESCE(st.departure_secs, st.arrival_secs) AS delay
+			FROM near n
+			JOIN trips t ON t.route_id = n.route_id
+			JOIN stop_times st ON st.trip_id = t.id AND st.stop_id = n.stop_id
+			JOIN calendar c ON c.service_id = t.service_id
+			CROSS JOIN LATERAL (VALUES (n.day, n.secs), (n.day - 1, n.prev_secs)) AS d(day, secs)
+			WHERE COALESCE(st.departure_secs, st.arrival_secs) IS NOT NULL
+			  AND d.day BETWEEN c.start_date AND c.end_date
+			  AND (ARRAY[c.monday, c.tuesday, c.wednesday, c.thursday, c.friday, c.saturday, c.sunday])[EXTRACT(ISODOW FROM d.day)::int]
+			  AND abs(d.secs - COALESCE(st.departure_secs, st.arrival_secs)) <= $7
+			ORDER BY n.bus_id, abs(d.secs - COALESCE(st.departure_secs, st.arrival_secs))
+		)
+		SELECT b.id, b.vehicle_code, b.registration_no, r.gtfs_id,
+		       m.gtfs_id, m.direction_id, m.day, m.stop_gtfs_id, m.stop_sequence, m.dist, m.delay
+		FROM v
+		JOIN buses b ON b.id = v.bus_id
+		LEFT JOIN routes r ON r.id = b.route_id
+		LEFT JOIN matched m ON m.bus_id = v.bus_id`,
+		busIDs, lats, lons, days, secs, prevSecs, int32(window.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []VehicleTrip
+	for rows.Next() {
+		var vt VehicleTrip
+		if err := rows.Scan(&vt.BusID, &vt.VehicleCode, &vt.RegistrationNo, &vt.RouteGTFSID,
+			&vt.TripGTFSID, &vt.DirectionID, &vt.ServiceDate, &vt.StopGTFSID, &vt.StopSequence, &vt.StopDistance, &vt.Delay); err != nil {
+			return nil, err
+		}
+		out = append(out, vt)
+	}
+	return out, rows.Err()
+}
+
+// ScheduledStop is one timed call of a trip. Arrival and Departure are
+// seconds after the start of the service day.
+type ScheduledStop struct {
+	Sequence   int
+	StopGTFSID string
+	Arrival    *int
+	Departure  *int
+}
+
+// TripStopTimes returns the calls of the given trips (by GTFS id) in sequence
+// order, keyed by trip GTFS id.
+func TripStopTimes(ctx context.Context, tripGTFSIDs []string) (map[string][]ScheduledStop, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT t.gtfs_id, st.stop_sequence, s.gtfs_id, st.arrival_secs, st.departure_secs
+		FROM trips t
+		JOIN stop_times st ON st.trip_id = t.id
+		JOIN stops s ON s.id = st.stop_id
+		WHERE t.gtfs_id = ANY($1::text[])
+		ORDER BY t.gtfs_id, st.stop_sequence`, tripGTFSIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string][]ScheduledStop, len(tripGTFSIDs))
+	for rows.Next() {
+		var tripID string
+		var s ScheduledStop
+		if err := rows.Scan(&tripID, &s.Sequence, &s.StopGTFSID, &s.Arrival, &s.Departure); err != nil {
+			return nil, err
+		}
+		out[tripID] = append(out[tripID], s)
+	}
+	return out, rows.Err()
+}
+
+// FeedLocation returns the timezone of the imported GTFS feed, which all its
+// agencies share, or UTC when no feed was imported.
+func FeedLocation(ctx context.Context) (*time.Location, error) {
+	var tz string
+	err := pool.QueryRow(ctx, `SELECT timezone FROM agencies ORDER BY gtfs_id LIMIT 1`).Scan(&tz)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(tz)
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned by RotateRefreshToken when the presented
+// token had already been rotated; its whole family has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Reasons stored in refresh_tokens.revoked_reason. Only a token revoked as
+// RevokedRotated signals theft when presented again.
+const (
+	RevokedRotated        = "rotated"
+	RevokedLogout         = "logout"
+	RevokedReuse          = "reuse"
+	RevokedSession        = "session_revoked"
+	RevokedPasswordChange = "password_change"
+	RevokedPasswordReset  = "password_reset"
+	RevokedLogoutAll      = "logout_all"
+	RevokedAdmin          = "admin_revoked"
+)
+
+// RefreshToken is the row behind a presented refresh token.
+type RefreshToken struct {
+	ID       string
+	UserID   string
+	FamilyID string
+}
+
+// StoreRefreshToken stores the first refresh token of a new family, i.e. a
+// new login session.
+func StoreRefreshToken(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	_, err := pool.Exec(ctx, `INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1,$2,$3)`, userID, tokenHash, expiresAt)
+	return err
+}
+
+// RotateRefreshToken revokes the token with oldHash and issues newHash in the
+// same family, in one transaction. The row lock makes concurrent rotations of
+// the same token serialize, so only one can succeed; the other sees a rotated
+// token and is treated as reuse. Returns ErrNotFound for unknown, expired or
+// otherwise revoked tokens, and ErrRefreshTokenReused (with the token) after
+// revoking the family of a reused one.
+func RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*RefreshToken, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	t := &RefreshToken{}
+	var revoked bool
+	var reason *string
+	var exp time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, family_id, revoked, revoked_reason, expires_at
+		FROM refresh_tokens WHERE token_hash=$1 FOR UPDATE`, oldHash).
+		Scan(&t.ID, &t.UserID, &t.FamilyID, &revoked, &reason, &exp)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	if revoked {
+		if reason == nil || *reason != RevokedRotated {
+			return nil, ErrNotFound
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE refresh_tokens SET revoked=true, revoked_at=now(), revoked_reason=$2
+			WHERE family_id=$1 AND revoked=false`, t.FamilyID, RevokedReuse); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		return t, ErrRefreshTokenReused
+	}
+	if !exp.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked=true, revoked_at=now(), revoked_reason=$2
+		WHERE id=$1`, t.ID, RevokedRotated); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (user_id, token_hash, expires_at, family_id)
+		VALUES ($1,$2,$3,$4)`, t.UserID, newHash, expiresAt, t.FamilyID); err != nil {
+		return nil, err
+	}
+	return t, tx.Commit(ctx)
+}
+
+// RevokeRefreshFamilyByHash ends the session the token belongs to.
+func RevokeRefreshFamilyByHash(ctx context.Context, tokenHash, reason string) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked=true, revoked_at=now(), revoked_reason=$2
+		WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash=$1)
+		  AND revoked=false`, tokenHash, reason)
+	return err
+}
+
+// Session is a refresh token family with an active (unrevoked, unexpired)
+// member, i.e. one logged-in device.
+type Session struct {
+	ID              string
+	CreatedAt       time.Time
+	LastRefreshedAt time.Time
+	ExpiresAt       time.Time
+}
+
+// ListSessions returns a user's active sessions, most recently refreshed first.
+func ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT t.family_id, f.created_at, t.issued_at, t.expires_at
+		FROM refresh_tokens t
+		JOIN (SELECT family_id, min(issued_at) AS created_at FROM refresh_tokens
+		      WHERE user_id=$1 GROUP BY family_id) f USING (family_id)
+		WHERE t.user_id=$1 AND t.revoked=false AND t.expires_at > now()
+		ORDER BY t.issued_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastRefreshedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// RevokeSession revokes one of a user's active sessions by family id.
+func RevokeSession(ctx context.Context, userID, familyID string) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked=true, revoked_at=now(), revoked_reason=$3
+		WHERE family_id=$1 AND user_id=$2 AND revoked=false AND expires_at > now()`, familyID, userID, RevokedSession)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes every refresh token of a user.
+func RevokeUserSessions(ctx context.Context, userID, reason string) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked=true, revoked_at=now(), revoked_reason=$2
+		WHERE user_id=$1 AND revoked=false`, userID, reason)
+	return err
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+type Route struct {
+	ID        string
+	Name      string
+	Number    *string
+	Metadata  map[string]interface{}
+	CreatedAt time.Time
+}
+
+// RouteFilter narrows ListRoutes; empty fields are ignored.
+type RouteFilter struct {
+	// Query matches name or number case-insensitively.
+	Query  string
+	Number string
+}
+
+const routeColumns = `id, name, number, COALESCE(metadata, '{}'::jsonb), created_at`
+
+func scanRoute(row interface{ Scan(...any) error }) (*Route, error) {
+	r := &Route{}
+	if err := row.Scan(&r.ID, &r.Name, &r.Number, &r.Metadata, &r.CreatedAt); err != nil {
+		return nil, mapError(err)
+	}
+	return r, nil
+}
+
+func CreateRoute(ctx context.Context, r *Route) (*Route, error) {
+	row := pool.QueryRow(ctx, `
+		INSERT INTO routes (name, number, metadata) VALUES ($1, $2, COALESCE($3, '{}'::jsonb))
+		RETURNING `+routeColumns, r.Name, r.Number, r.Metadata)
+	return scanRoute(row)
+}
+
+func GetRoute(ctx context.Context, id string) (*Route, error) {
+	return scanRoute(pool.QueryRow(ctx, `SELECT `+routeColumns+` FROM routes WHERE id = $1`, id))
+}
+
+func UpdateRoute(ctx context.Context, r *Route) (*Route, error) {
+	row := pool.QueryRow(ctx, `
+		UPDATE routes SET name = $2, number = $3, metadata = COALESCE($4, '{}'::jsonb)
+		WHERE id = $1
+		RETURNING `+routeColumns, r.ID, r.Name, r.Number, r.Metadata)
+	return scanRoute(row)
+}
+
+// DeleteRoute removes a route. Its stops are deleted with it and its buses
+// are unassigned (see migration 0002).
+func DeleteRoute(ctx context.Context, id string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM routes WHERE id = $1`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListRoutes returns one page of routes ordered by number then name, and the
+// total number of matching routes.
+func ListRoutes(ctx context.Context, f RouteFilter, opts ListOptions) ([]Route, int, error) {
+	const where = `
+		WHERE ($1 = '' OR name ILIKE '%' || $1 || '%' OR number ILIKE '%' || $1 || '%')
+		  AND ($2 = '' OR number = $2)`
+	var total int
+	if err := pool.QueryRow(ctx, `SELECT count(*) FROM routes`+where, f.Query, f.Number).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := pool.Query(ctx, `SELECT `+routeColumns+` FROM routes`+where+`
+		ORDER BY number NULLS LAST, name, id
+		LIMIT $3 OFFSET $4`, f.Query, f.Number, opts.Limit, opts.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var out []Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, *r)
+	}
+	return out, total, rows.Err()
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Stop event kinds.
+const (
+	StopArrived  = "arrived"
+	StopDeparted = "departed"
+)
+
+// StopProbe is a fix to look up the nearby stop of its route for.
+type StopProbe struct {
+	RouteID string
+	Lat     float64
+	Lon     float64
+}
+
+// NearbyStop is the stop of a route closest to a probe.
+type NearbyStop struct {
+	ID       string
+	Name     string
+	Distance float64
+}
+
+// NearestRouteStops returns, for each probe, the stop of its route closest to
+// it within radius meters, or nil when there is none.
+func NearestRouteStops(ctx context.Context, probes []StopProbe, radius float64) ([]*NearbyStop, error) {
+	n := len(probes)
+	routeIDs, lats, lons := make([]string, n), make([]float64, n), make([]float64, n)
+	for i, p := range probes {
+		routeIDs[i], lats[i], lons[i] = p.RouteID, p.Lat, p.Lon
+	}
+	rows, err := pool.Query(ctx, `
+		SELECT v.i, s.id, s.name, s.dist
+		FROM unnest($1::uuid[], $2::float8[], $3::float8[]) WITH ORDINALITY AS v(route_id, lat, lon, i)
+		CROSS JOIN LATERAL (
+			SELECT id, name,
+			       ST_Distance(geom::geography, ST_SetSRID(ST_MakePoint(v.lon, v.lat), 4326)::geography) AS dist
+			FROM stops
+			WHERE route_id = v.route_id
+			  AND ST_DWithin(geom::geography, ST_SetSRID(ST_MakePoint(v.lon, v.lat), 4326)::geography, $4)
+			ORDER BY dist
+			LIMIT 1
+		) s`, routeIDs, lats, lons, radius)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]*NearbyStop, n)
+	for rows.Next() {
+		var i int
+		s := &NearbyStop{}
+		if err := rows.Scan(&i, &s.ID, &s.Name, &s.Distance); err != nil {
+			return nil, err
+		}
+		out[i-1] = s
+	}
+	return out, rows.Err()
+}
+
+// StopEvent is a bus arriving at or departing from a stop.
+type StopEvent struct {
+	BusID   string
+	RouteID *string
+	StopID  string
+	Event   string
+	Ts      time.Time
+	// DwellSeconds is the time spent at the stop, set on departures.
+	DwellSeconds *int
+}
+
+// InsertStopEvents writes events with one multi-row INSERT.
+func InsertStopEvents(ctx context.Context, events []StopEvent) error {
+	n := len(events)
+	busIDs, routeIDs, stopIDs, kinds := make([]string, n), make([]*string, n), make([]string, n), make([]string, n)
+	ts, dwells := make([]time.Time, n), make([]*int32, n)
+	for i, e := range events {
+		busIDs[i], routeIDs[i], stopIDs[i], kinds[i], ts[i] = e.BusID, e.RouteID, e.StopID, e.Event, e.Ts
+		if e.DwellSeconds != nil {
+			d := int32(*e.DwellSeconds)
+			dwells[i] = &d
+		}
+	}
+	_, err := pool.Exec(ctx, `
+		INSERT INTO stop_events (bus_id, route_id, stop_id, event, ts, dwell_seconds)
+		SELECT * FROM unnest($1::uuid[], $2::uuid[], $3::uuid[], $4::text[], $5::timestamptz[], $6::int[])
+	`, busIDs, routeIDs, stopIDs, kinds, ts, dwells)
+	return err
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Stop struct {
+	ID        string
+	RouteID   *string
+	Name      string
+	Latitude  float64
+	Longitude float64
+	Seq       *int
+}
+
+// StopFilter narrows ListStops; empty fields are ignored.
+type StopFilter struct {
+	RouteID string
+	// Query matches the stop name case-insensitively.
+	Query string
+}
+
+const stopColumns = `id, route_id, name, latitude, longitude, seq`
+
+func scanStop(row interface{ Scan(...any) error }) (*Stop, error) {
+	s := &Stop{}
+	if err := row.Scan(&s.ID, &s.RouteID, &s.Name, &s.Latitude, &s.Longitude, &s.Seq); err != nil {
+		return nil, mapError(err)
+	}
+	return s, nil
+}
+
+func CreateStop(ctx context.Context, s *Stop) (*Stop, error) {
+	row := pool.QueryRow(ctx, `
+		INSERT INTO stops (route_id, name, latitude, longitude, seq) VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+stopColumns, s.RouteID, s.Name, s.Latitude, s.Longitude, s.Seq)
+	return scanStop(row)
+}
+
+func GetStop(ctx context.Context, id string) (*Stop, error) {
+	return scanStop(pool.QueryRow(ctx, `SELECT `+stopColumns+` FROM stops WHERE id = $1`, id))
+}
+
+func UpdateStop(ctx context.Context, s *Stop) (*Stop, error) {
+	row := pool.QueryRow(ctx, `
+		UPDATE stops SET route_id = $2, name = $3, latitude = $4, longitude = $5, seq = $6
+		WHERE id = $1
+		RETURNING `+stopColumns, s.ID, s.RouteID, s.Name, s.Latitude, s.Longitude, s.Seq)
+	return scanStop(row)
+}
+
+func DeleteStop(ctx context.Context, id string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM stops WHERE id = $1`, id)
+	if err != nil {
+		return mapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListStops returns one page of stops ordered by route and sequence, and the
+// total number of matching stops.
+func ListStops(ctx context.Context, f StopFilter, opts ListOptions) ([]Stop, int, error) {
+	const where = `
+		WHERE ($1 = '' OR route_id::text = $1)
+		  AND ($2 = '' OR name ILIKE '%' || $2 || '%')`
+	var total int
+	if err := pool.QueryRow(ctx, `SELECT count(*) FROM stops`+where, f.RouteID, f.Query).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := pool.Query(ctx, `SELECT `+stopColumns+` FROM stops`+where+`
+		ORDER BY route_id, seq NULLS LAST, name, id
+		LIMIT $3 OFFSET $4`, f.RouteID, f.Query, opts.Limit, opts.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out, err := collectStops(rows)
+	return out, total, err
+}
+
+// ListRouteStops returns every stop of a route in travel order.
+func ListRouteStops(ctx context.Context, routeID string) ([]Stop, error) {
+	rows, err := pool.Query(ctx, `SELECT `+stopColumns+` FROM stops
+		WHERE route_id = $1
+		ORDER BY seq NULLS LAST, name, id`, routeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return collectStops(rows)
+}
+
+// ReorderRouteStops sets seq to 1..n following stopIDs, which must list every
+// stop of the route exactly once.
+func ReorderRouteStops(ctx context.Context, routeID string, stopIDs []string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var count int
+	if err := tx.QueryRow(ctx, `SELECT count(*) FROM stops WHERE route_id = $1`, routeID).Scan(&count); err != nil {
+		return err
+	}
+	if count != len(stopIDs) {
+		return fmt.Errorf("%w: expected %d stop ids, got %d", ErrInvalidReference, count, len(stopIDs))
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE stops s SET seq = o.seq
+		FROM unnest($2::uuid[]) WITH ORDINALITY AS o(id, seq)
+		WHERE s.id = o.id AND s.route_id = $1`, routeID, stopIDs)
+	if err != nil {
+		return mapError(err)
+	}
+	if int(tag.RowsAffected()) != len(stopIDs) {
+		return fmt.Errorf("%w: stop ids must belong to the route and be unique", ErrInvalidReference)
+	}
+	return tx.Commit(ctx)
+}
+
+func collectStops(rows pgx.Rows) ([]Stop, error) {
+	var out []Stop
+	for rows.Next() {
+		s, err := scanStop(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,389 @@
+// Package eta predicts when live vehicles reach the stops of their route.
+//
+// A vehicle's last fix is snapped onto the route, drawn as a polyline through
+// its stops in travel order. The remaining distance to each stop is then
+// covered at the speeds recently recorded on each stop-to-stop segment.
+// Fixes are taken at a steady rate, so the plain mean of the reported speeds
+// on a segment is its average speed including time spent at stops and in
+// traffic. Bounds use that mean plus and minus one standard deviation.
+package eta
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrNotLive is returned for vehicles without a fresh fix.
+	ErrNotLive = errors.New("vehicle is not live")
+	// ErrNoRoute is returned for vehicles not assigned to a route with at
+	// least two stops.
+	ErrNoRoute = errors.New("vehicle has no route")
+	// ErrOffRoute is returned when the vehicle is too far from its route or
+	// moving against the stop order.
+	ErrOffRoute = errors.New("vehicle is not on its route")
+)
+
+const (
+	// maxOffset is how far from the route a fix may be and still count as on it.
+	maxOffset = 150.0
+	// minSamples is how many fixes a segment needs before its own speed is
+	// trusted over the route average.
+	minSamples = 5
+	// minSpeed (km/h) keeps a segment where buses stood still from
+	// predicting an endless wait.
+	minSpeed = 3.0
+	// reverseTolerance is how far (m) a vehicle may move backwards along the
+	// route, e.g. GPS noise, before it counts as running the other way.
+	reverseTolerance = 30.0
+	// maxRouteBuses bounds the buses whose history feeds the speed model.
+	maxRouteBuses = 500
+)
+
+// defaultSpeed (km/h mean and deviation) applies to routes without history.
+var defaultSpeed = speedStats{mean: 20, sd: 8}
+
+// Estimator predicts arrivals. Speed models are built from the last window of
+// positions and cached per route for ttl.
+type Estimator struct {
+	redis      *redisclient.Client
+	staleAfter time.Duration
+	window     time.Duration
+	ttl        time.Duration
+
+	mu     sync.Mutex
+	routes map[string]*routeModel
+}
+
+func NewEstimator(r *redisclient.Client, staleAfter, window, ttl time.Duration) *Estimator {
+	return &Estimator{redis: r, staleAfter: staleAfter, window: window, ttl: ttl, routes: make(map[string]*routeModel)}
+}
+
+// StopETA is the predicted arrival of one vehicle at one stop. ETA is from
+// now; Min and Max bound it. Max assumes the vehicle has not moved since its
+// last fix.
+type StopETA struct {
+	Stop db.Stop
+	// Distance is the remaining distance along the route in meters.
+	Distance float64
+	ETA      time.Duration
+	Min      time.Duration
+	Max      time.Duration
+}
+
+// VehicleETA lists the upcoming stops of a vehicle.
+type VehicleETA struct {
+	Bus   *db.Bus
+	FixAt time.Time
+	Stops []StopETA
+}
+
+// Arrival is one vehicle approaching a stop.
+type Arrival struct {
+	Bus   *db.Bus
+	FixAt time.Time
+	StopETA
+}
+
+// Vehicle predicts arrival times at the next limit stops of bus.
+func (e *Estimator) Vehicle(ctx context.Context, bus *db.Bus, limit int) (*VehicleETA, error) {
+	if bus.RouteID == nil {
+		return nil, ErrNoRoute
+	}
+	fixes, err := e.lastFixes(ctx, []string{bus.ID})
+	if err != nil {
+		return nil, err
+	}
+	fix, ok := fixes[bus.ID]
+	if !ok {
+		return nil, ErrNotLive
+	}
+	m, err := e.model(ctx, *bus.RouteID)
+	if err != nil {
+		return nil, err
+	}
+	if m.path == nil {
+		return nil, ErrNoRoute
+	}
+	along, ok := m.progress(bus.ID, fix)
+	if !ok {
+		return nil, ErrOffRoute
+	}
+
+	now := time.Now()
+	out := &VehicleETA{Bus: bus, FixAt: fix.ts}
+	for i, s := range m.stops {
+		if m.path.cum[i] < along-reverseTolerance {
+			continue
+		}
+		out.Stops = append(out.Stops, m.estimate(s, along, m.path.cum[i], fix.ts, now))
+		if len(out.Stops) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// Stop predicts the next limit arrivals at stop, soonest first, from every
+// live vehicle of the stop's route that has not passed it yet.
+func (e *Estimator) Stop(ctx context.Context, stop *db.Stop, limit int) ([]Arrival, error) {
+	if stop.RouteID == nil {
+		return nil, nil
+	}
+	m, err := e.model(ctx, *stop.RouteID)
+	if err != nil || m.path == nil {
+		return nil, err
+	}
+	idx := -1
+	for i, s := range m.stops {
+		if s.ID == stop.ID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(m.buses))
+	for i, b := range m.buses {
+		ids[i] = b.ID
+	}
+	fixes, err := e.lastFixes(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var out []Arrival
+	for i := range m.buses {
+		b := &m.buses[i]
+		fix, ok := fixes[b.ID]
+		if !ok {
+			continue
+		}
+		along, ok := m.progress(b.ID, fix)
+		if !ok || m.path.cum[idx] < along-reverseTolerance {
+			continue
+		}
+		out = append(out, Arrival{Bus: b, FixAt: fix.ts, StopETA: m.estimate(m.stops[idx], along, m.path.cum[idx], fix.ts, now)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ETA < out[j].ETA })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+type fix struct {
+	ts       time.Time
+	lat, lon float64
+}
+
+// lastFixes reads vehicle:<id>:last for busIDs, leaving out stale ones.
+func (e *Estimator) lastFixes(ctx context.Context, busIDs []string) (map[string]fix, error) {
+	out := make(map[string]fix, len(busIDs))
+	if len(busIDs) == 0 {
+		return out, nil
+	}
+	cmds := make([]*redis.MapStringStringCmd, len(busIDs))
+	pipe := e.redis.RDB().Pipeline()
+	for i, id := range busIDs {
+		cmds[i] = pipe.HGetAll(ctx, "vehicle:"+id+":last")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-e.staleAfter).Unix()
+	for i, id := range busIDs {
+		last := cmds[i].Val()
+		ts, err := strconv.ParseInt(last["ts"], 10, 64)
+		if err != nil || ts < cutoff {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(last["lat"], 64)
+		lon, errLon := strconv.ParseFloat(last["lon"], 64)
+		if errLat != nil || errLon != nil {
+			continue
+		}
+		out[id] = fix{ts: time.Unix(ts, 0), lat: lat, lon: lon}
+	}
+	return out, nil
+}
+
+type speedStats struct {
+	mean, sd float64 // km/h
+}
+
+type trailPoint struct {
+	ts    time.Time
+	along float64
+}
+
+// routeModel is a route's geometry and recent speeds.
+type routeModel struct {
+	built time.Time
+	stops []db.Stop
+	buses []db.Bus
+	// path is nil when the route has fewer than two stops.
+	path *path
+	// segments[i] is the speed between stop i and i+1.
+	segments []speedStats
+	// trails holds each bus's recent progress along the route, oldest first.
+	trails map[string][]trailPoint
+}
+
+// model returns the cached model of a route, rebuilding it when older than
+// ttl. Routes with fewer than two stops get a model without a path.
+func (e *Estimator) model(ctx context.Context, routeID string) (*routeModel, error) {
+	e.mu.Lock()
+	m, ok := e.routes[routeID]
+	e.mu.Unlock()
+	if ok && time.Since(m.built) < e.ttl {
+		return m, nil
+	}
+
+	m, err := e.build(ctx, routeID)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.routes[routeID] = m
+	e.mu.Unlock()
+	return m, nil
+}
+
+func (e *Estimator) build(ctx context.Context, routeID string) (*routeModel, error) {
+	now := time.Now()
+	stops, err := db.ListRouteStops(ctx, routeID)
+	if err != nil {
+		return nil, err
+	}
+	buses, _, err := db.ListBuses(ctx, db.BusFilter{RouteID: routeID}, db.ListOptions{Limit: maxRouteBuses})
+	if err != nil {
+		return nil, err
+	}
+	if len(stops) < 2 {
+		// Cache the miss too, so such routes do not hit the database on
+		// every request.
+		return &routeModel{built: now}, nil
+	}
+
+	lats, lons := make([]float64, len(stops)), make([]float64, len(stops))
+	for i, s := range stops {
+		lats[i], lons[i] = s.Latitude, s.Longitude
+	}
+	m := &routeModel{built: now, stops: stops, buses: buses, path: newPath(lats, lons), trails: make(map[string][]trailPoint)}
+
+	var positions []db.Position
+	if len(buses) > 0 {
+		ids := make([]string, len(buses))
+		for i, b := range buses {
+			ids[i] = b.ID
+		}
+		if positions, err = db.ListRoutePositions(ctx, routeID, ids, now.Add(-e.window)); err != nil {
+			return nil, err
+		}
+	}
+
+	n := len(stops) - 1
+	sum, sumSq, count := make([]float64, n), make([]float64, n), make([]int, n)
+	var allSum, allSumSq float64
+	var allCount int
+	for _, p := range positions {
+		along, offset := m.path.locate(p.Lat, p.Lon)
+		if offset > maxOffset {
+			continue
+		}
+		m.trails[p.BusID] = append(m.trails[p.BusID], trailPoint{ts: p.Ts, along: along})
+		if p.SpeedKph == nil {
+			continue
+		}
+		v := *p.SpeedKph
+		i := m.path.segment(along)
+		sum[i], sumSq[i], count[i] = sum[i]+v, sumSq[i]+v*v, count[i]+1
+		allSum, allSumSq, allCount = allSum+v, allSumSq+v*v, allCount+1
+	}
+
+	route := defaultSpeed
+	if allCount >= minSamples {
+		route = stats(allSum, allSumSq, allCount)
+	}
+	m.segments = make([]speedStats, n)
+	for i := range m.segments {
+		m.segments[i] = route
+		if count[i] >= minSamples {
+			m.segments[i] = stats(sum[i], sumSq[i], count[i])
+		}
+	}
+	return m, nil
+}
+
+func stats(sum, sumSq float64, n int) speedStats {
+	mean := sum / float64(n)
+	variance := math.Max(0, sumSq/float64(n)-mean*mean)
+	return speedStats{mean: mean, sd: math.Sqrt(variance)}
+}
+
+// progress snaps a fix onto the route. It fails when the fix is off the
+// route or, judging by the bus's trail, the bus is running against the stop
+// order.
+func (m *routeModel) progress(busID string, f fix) (float64, bool) {
+	if m.path == nil {
+		return 0, false
+	}
+	along, offset := m.path.locate(f.lat, f.lon)
+	if offset > maxOffset {
+		return 0, false
+	}
+	trail := m.trails[busID]
+	for i := len(trail) - 1; i >= 0; i-- {
+		if f.ts.Sub(trail[i].ts) >= time.Minute {
+			if along < trail[i].along-reverseTolerance {
+				return 0, false
+			}
+			break
+		}
+	}
+	return along, true
+}
+
+// estimate covers from..to along the route at each segment's speed. The
+// vehicle is assumed to have kept moving since fixAt for ETA and Min.
+func (m *routeModel) estimate(stop db.Stop, from, to float64, fixAt, now time.Time) StopETA {
+	var mid, fast, slow float64 // seconds
+	for i, s := range m.segments {
+		lo, hi := math.Max(from, m.path.cum[i]), math.Min(to, m.path.cum[i+1])
+		if hi <= lo {
+			continue
+		}
+		d := hi - lo
+		mid += d / kph(s.mean)
+		fast += d / kph(s.mean+s.sd)
+		slow += d / kph(s.mean-s.sd)
+	}
+	elapsed := now.Sub(fixAt).Seconds()
+	return StopETA{
+		Stop:     stop,
+		Distance: math.Max(0, to-from),
+		ETA:      seconds(mid - elapsed),
+		Min:      seconds(fast - elapsed),
+		Max:      seconds(slow),
+	}
+}
+
+// kph converts a speed to m/s, floored at minSpeed.
+func kph(v float64) float64 {
+	return math.Max(v, minSpeed) / 3.6
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Max(0, math.Round(s))) * time.Second
+}
@@ -0,0 +1,63 @@
+package eta
+
+import "math"
+
+const earthRadius = 6371000.0
+
+// path is a route's stops as a polyline in a local planar projection
+// (equirectangular around the first stop), good to well under a percent over
+// the extent of a city route.
+type path struct {
+	lat0, lon0, cosLat float64
+	xs, ys             []float64
+	// cum[i] is the distance along the path from the first stop to stop i.
+	cum []float64
+}
+
+func newPath(lats, lons []float64) *path {
+	p := &path{lat0: lats[0], lon0: lons[0], cosLat: math.Cos(lats[0] * math.Pi / 180)}
+	p.xs, p.ys, p.cum = make([]float64, len(lats)), make([]float64, len(lats)), make([]float64, len(lats))
+	for i := range lats {
+		p.xs[i], p.ys[i] = p.project(lats[i], lons[i])
+		if i > 0 {
+			p.cum[i] = p.cum[i-1] + math.Hypot(p.xs[i]-p.xs[i-1], p.ys[i]-p.ys[i-1])
+		}
+	}
+	return p
+}
+
+func (p *path) project(lat, lon float64) (x, y float64) {
+	x = (lon - p.lon0) * math.Pi / 180 * earthRadius * p.cosLat
+	y = (lat - p.lat0) * math.Pi / 180 * earthRadius
+	return x, y
+}
+
+// locate snaps a point to the closest point of the path and returns how far
+// along the path that is and how far the point is from it, both in meters.
+func (p *path) locate(lat, lon float64) (along, offset float64) {
+	x, y := p.project(lat, lon)
+	offset = math.Inf(1)
+	for i := 0; i+1 < len(p.xs); i++ {
+		dx, dy := p.xs[i+1]-p.xs[i], p.ys[i+1]-p.ys[i]
+		seg := dx*dx + dy*dy
+		t := 0.0
+		if seg > 0 {
+			t = math.Max(0, math.Min(1, ((x-p.xs[i])*dx+(y-p.ys[i])*dy)/seg))
+		}
+		d := math.Hypot(x-(p.xs[i]+t*dx), y-(p.ys[i]+t*dy))
+		if d < offset {
+			offset, along = d, p.cum[i]+t*(p.cum[i+1]-p.cum[i])
+		}
+	}
+	return along, offset
+}
+
+// segment returns the index of the stop-to-stop segment containing along.
+func (p *path) segment(along float64) int {
+	for i := 1; i < len(p.cum)-1; i++ {
+		if along < p.cum[i] {
+			return i - 1
+		}
+	}
+	return len(p.cum) - 2
+}
@@ -0,0 +1,160 @@
+// Package geofence tests points against geofences in memory.
+//
+// Fences are bucketed by bounding box into a grid of cellSize-degree cells,
+// so a lookup only runs exact tests against the fences overlapping the
+// point's cell. Fences spanning more than maxCells cells are kept in a list
+// tested for every point instead.
+package geofence
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+)
+
+// VersionKey is incremented in Redis whenever geofences change, so workers
+// know to reload them.
+const VersionKey = "geofences:version"
+
+const (
+	cellSize    = 0.01 // degrees, about 1.1 km of latitude
+	maxCells    = 256
+	earthRadius = 6371000.0
+)
+
+// Fence is a geofence ready for point tests.
+type Fence struct {
+	ID   string
+	Name string
+	// DwellAfter raises a dwell event after this long inside; zero disables it.
+	DwellAfter time.Duration
+
+	// circle
+	lat, lon, radius float64
+	// polygon rings of [lon, lat], exterior first
+	rings [][][2]float64
+
+	minLat, minLon, maxLat, maxLon float64
+}
+
+// NewFence prepares g for point tests.
+func NewFence(g *db.Geofence) *Fence {
+	f := &Fence{ID: g.ID, Name: g.Name}
+	if g.DwellSeconds != nil {
+		f.DwellAfter = time.Duration(*g.DwellSeconds) * time.Second
+	}
+	if g.Kind == db.GeofenceCircle {
+		f.lat, f.lon, f.radius = *g.Latitude, *g.Longitude, *g.RadiusMeters
+		dLat := f.radius / earthRadius * 180 / math.Pi
+		dLon := dLat / math.Max(math.Cos(f.lat*math.Pi/180), 1e-6)
+		f.minLat, f.maxLat = f.lat-dLat, f.lat+dLat
+		f.minLon, f.maxLon = f.lon-dLon, f.lon+dLon
+		return f
+	}
+	f.rings = g.Polygon
+	f.minLat, f.minLon, f.maxLat, f.maxLon = 90, 180, -90, -180
+	for _, p := range f.rings[0] {
+		f.minLon, f.maxLon = math.Min(f.minLon, p[0]), math.Max(f.maxLon, p[0])
+		f.minLat, f.maxLat = math.Min(f.minLat, p[1]), math.Max(f.maxLat, p[1])
+	}
+	return f
+}
+
+// Contains reports whether the point is inside the fence. Points on a
+// polygon's edge may fall either way.
+func (f *Fence) Contains(lat, lon float64) bool {
+	if lat < f.minLat || lat > f.maxLat || lon < f.minLon || lon > f.maxLon {
+		return false
+	}
+	if f.rings == nil {
+		return distance(f.lat, f.lon, lat, lon) <= f.radius
+	}
+	if !inRing(f.rings[0], lat, lon) {
+		return false
+	}
+	for _, hole := range f.rings[1:] {
+		if inRing(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRing is the even-odd ray casting test in plain lon/lat, which is exact
+// enough at geofence scale.
+func inRing(ring [][2]float64, lat, lon float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi, xj, yj := ring[i][0], ring[i][1], ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+// distance is the haversine distance in meters.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLat, dLon := p2-p1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type cell struct{ x, y int }
+
+func cellOf(lat, lon float64) cell {
+	return cell{int(math.Floor(lon / cellSize)), int(math.Floor(lat / cellSize))}
+}
+
+// Index finds the fences containing a point. It is immutable once built and
+// safe for concurrent use.
+type Index struct {
+	fences map[string]*Fence
+	cells  map[cell][]*Fence
+	large  []*Fence
+}
+
+func NewIndex(geofences []db.Geofence) *Index {
+	ix := &Index{fences: make(map[string]*Fence, len(geofences)), cells: make(map[cell][]*Fence)}
+	for i := range geofences {
+		f := NewFence(&geofences[i])
+		ix.fences[f.ID] = f
+		lo, hi := cellOf(f.minLat, f.minLon), cellOf(f.maxLat, f.maxLon)
+		if (hi.x-lo.x+1)*(hi.y-lo.y+1) > maxCells {
+			ix.large = append(ix.large, f)
+			continue
+		}
+		for x := lo.x; x <= hi.x; x++ {
+			for y := lo.y; y <= hi.y; y++ {
+				ix.cells[cell{x, y}] = append(ix.cells[cell{x, y}], f)
+			}
+		}
+	}
+	return ix
+}
+
+// Len is the number of indexed fences.
+func (ix *Index) Len() int { return len(ix.fences) }
+
+// Get returns the fence with id, or nil when it is not indexed.
+func (ix *Index) Get(id string) *Fence { return ix.fences[id] }
+
+// Containing returns the fences containing the point, ordered by ID.
+func (ix *Index) Containing(lat, lon float64) []*Fence {
+	var out []*Fence
+	for _, f := range ix.cells[cellOf(lat, lon)] {
+		if f.Contains(lat, lon) {
+			out = append(out, f)
+		}
+	}
+	for _, f := range ix.large {
+		if f.Contains(lat, lon) {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
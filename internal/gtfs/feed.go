@@ -0,0 +1,182 @@
+// Package gtfs reads and validates GTFS static feeds.
+package gtfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Feed is the subset of a GTFS static feed the backend imports.
+type Feed struct {
+	Agencies  []Agency
+	Routes    []Route
+	Stops     []Stop
+	Trips     []Trip
+	StopTimes []StopTime
+	Shapes    []Shape
+	Calendar  []Service
+}
+
+type Agency struct {
+	ID       string
+	Name     string
+	URL      string
+	Timezone string
+	Lang     string
+	Phone    string
+}
+
+type Route struct {
+	ID        string
+	AgencyID  string
+	ShortName string
+	LongName  string
+	Type      int
+	Color     string
+	TextColor string
+}
+
+// DisplayName is the long name, or the short name when there is none.
+func (r *Route) DisplayName() string {
+	if r.LongName != "" {
+		return r.LongName
+	}
+	return r.ShortName
+}
+
+type Stop struct {
+	ID   string
+	Code string
+	Name string
+	Lat  float64
+	Lon  float64
+	// LocationType is 0 for a stop or platform, 1 for a station, 2-4 for
+	// entrances, generic nodes and boarding areas.
+	LocationType  int
+	ParentStation string
+}
+
+type Trip struct {
+	ID          string
+	RouteID     string
+	ServiceID   string
+	Headsign    string
+	DirectionID *int
+	BlockID     string
+	ShapeID     string
+}
+
+// StopTime is one call of a trip at a stop. Arrival and Departure are seconds
+// after midnight of the service day, nil for stops without a scheduled time.
+type StopTime struct {
+	TripID    string
+	StopID    string
+	Sequence  int
+	Arrival   *int
+	Departure *int
+}
+
+type ShapePoint struct {
+	Lat      float64
+	Lon      float64
+	Sequence int
+}
+
+// Shape is a trip's path, points in sequence order.
+type Shape struct {
+	ID     string
+	Points []ShapePoint
+}
+
+// Service is one calendar.txt row: the weekdays a service runs (Monday
+// first) between Start and End inclusive.
+type Service struct {
+	ID    string
+	Days  [7]bool
+	Start time.Time
+	End   time.Time
+}
+
+// RouteStops returns, per route id, the ids of the stops its trips call at in
+// travel order. The order follows the trip with the most stops in the lowest
+// direction; stops only served by other trips are appended in the order those
+// trips reach them.
+func (f *Feed) RouteStops() map[string][]string {
+	calls := make(map[string][]StopTime)
+	for _, st := range f.StopTimes {
+		calls[st.TripID] = append(calls[st.TripID], st)
+	}
+	byRoute := make(map[string][]*Trip)
+	for i := range f.Trips {
+		t := &f.Trips[i]
+		byRoute[t.RouteID] = append(byRoute[t.RouteID], t)
+	}
+
+	out := make(map[string][]string, len(byRoute))
+	for routeID, trips := range byRoute {
+		sort.SliceStable(trips, func(i, j int) bool {
+			di, dj := direction(trips[i]), direction(trips[j])
+			if di != dj {
+				return di < dj
+			}
+			ni, nj := len(calls[trips[i].ID]), len(calls[trips[j].ID])
+			if ni != nj {
+				return ni > nj
+			}
+			return trips[i].ID < trips[j].ID
+		})
+		seen := make(map[string]bool)
+		var order []string
+		for _, t := range trips {
+			sts := calls[t.ID]
+			sort.Slice(sts, func(i, j int) bool { return sts[i].Sequence < sts[j].Sequence })
+			for _, st := range sts {
+				if !seen[st.StopID] {
+					seen[st.StopID] = true
+					order = append(order, st.StopID)
+				}
+			}
+		}
+		out[routeID] = order
+	}
+	return out
+}
+
+func direction(t *Trip) int {
+	if t.DirectionID == nil {
+		return 0
+	}
+	return *t.DirectionID
+}
+
+// ValidationError points at the row of a feed file that is invalid. Line is
+// the 1-based line in the file; 0 means the problem concerns the whole file.
+type ValidationError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.File + ": " + e.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// ValidationErrors is returned by Parse when the feed has invalid rows.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, min(len(e), 3))
+	for _, v := range e[:min(len(e), 3)] {
+		msgs = append(msgs, v.Error())
+	}
+	s := strings.Join(msgs, "; ")
+	if len(e) > 3 {
+		s += fmt.Sprintf(" (and %d more)", len(e)-3)
+	}
+	return "invalid GTFS feed: " + s
+}
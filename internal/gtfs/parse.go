@@ -0,0 +1,596 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrors caps how many validation errors are collected; a feed that bad
+// is not worth reading further.
+const maxErrors = 1000
+
+// ParseFile reads a GTFS zip from disk. See Parse.
+func ParseFile(name string) (*Feed, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Parse(f, fi.Size())
+}
+
+// Parse reads and validates a GTFS zip. Rows are checked for required fields,
+// formats and references to other files; if any are invalid the returned
+// error is a ValidationErrors listing every problem by file and line, and no
+// feed is returned.
+func Parse(r io.ReaderAt, size int64) (*Feed, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("read zip: %w", err)
+	}
+	p := &parser{files: make(map[string]*zip.File), feed: &Feed{}}
+	for _, f := range zr.File {
+		// Some producers zip the feed inside a folder.
+		p.files[path.Base(f.Name)] = f
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	return p.feed, nil
+}
+
+type parser struct {
+	files map[string]*zip.File
+	feed  *Feed
+	errs  ValidationErrors
+
+	agencies  map[string]bool
+	routes    map[string]bool
+	services  map[string]bool
+	shapes    map[string]bool
+	stops     map[string]bool
+	tripLines map[string]int
+}
+
+func (p *parser) errorf(file string, line int, format string, args ...any) {
+	if len(p.errs) == maxErrors {
+		p.errs = append(p.errs, ValidationError{File: file, Line: line, Message: "too many errors, stopped checking"})
+	}
+	if len(p.errs) > maxErrors {
+		return
+	}
+	p.errs = append(p.errs, ValidationError{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// parse reads the files in dependency order so each row's references can be
+// checked when it is read.
+func (p *parser) parse() error {
+	for _, step := range []func() error{p.parseAgencies, p.parseRoutes, p.parseCalendar, p.parseShapes, p.parseStops, p.parseTrips, p.parseStopTimes} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseAgencies() error {
+	t, err := p.open("agency.txt", true, "agency_name", "agency_url", "agency_timezone")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	p.agencies = make(map[string]bool)
+	for t.next() {
+		a := Agency{
+			ID:       t.str("agency_id"),
+			Name:     t.required("agency_name"),
+			URL:      t.required("agency_url"),
+			Timezone: t.required("agency_timezone"),
+			Lang:     t.str("agency_lang"),
+			Phone:    t.str("agency_phone"),
+		}
+		if a.Timezone != "" {
+			if _, err := time.LoadLocation(a.Timezone); err != nil {
+				t.invalid("agency_timezone", a.Timezone)
+			}
+		}
+		if !t.unique(p.agencies, a.ID, "agency_id") || t.bad {
+			continue
+		}
+		p.feed.Agencies = append(p.feed.Agencies, a)
+	}
+	return t.err
+}
+
+var hexColor = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
+
+func (p *parser) parseRoutes() error {
+	t, err := p.open("routes.txt", true, "route_id", "route_type")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	p.routes = make(map[string]bool)
+	for t.next() {
+		r := Route{
+			ID:        t.required("route_id"),
+			AgencyID:  t.str("agency_id"),
+			ShortName: t.str("route_short_name"),
+			LongName:  t.str("route_long_name"),
+			Type:      t.int("route_type", true),
+			Color:     t.str("route_color"),
+			TextColor: t.str("route_text_color"),
+		}
+		if r.ShortName == "" && r.LongName == "" {
+			t.fail("route_short_name or route_long_name is required")
+		}
+		if r.AgencyID == "" && len(p.agencies) > 1 {
+			t.fail("agency_id is required when the feed has several agencies")
+		}
+		if r.AgencyID != "" && !p.agencies[r.AgencyID] {
+			t.fail("agency_id %q not found in agency.txt", r.AgencyID)
+		}
+		if r.Color != "" && !hexColor.MatchString(r.Color) {
+			t.invalid("route_color", r.Color)
+		}
+		if r.TextColor != "" && !hexColor.MatchString(r.TextColor) {
+			t.invalid("route_text_color", r.TextColor)
+		}
+		if !t.unique(p.routes, r.ID, "route_id") || t.bad {
+			continue
+		}
+		p.feed.Routes = append(p.feed.Routes, r)
+	}
+	return t.err
+}
+
+func (p *parser) parseCalendar() error {
+	p.services = make(map[string]bool)
+	// calendar_dates.txt alone may define every service; it is not imported,
+	// so service ids are only checked against calendar.txt when there is no
+	// calendar_dates.txt.
+	_, hasDates := p.files["calendar_dates.txt"]
+	t, err := p.open("calendar.txt", !hasDates, "service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	days := []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+	for t.next() {
+		s := Service{
+			ID:    t.required("service_id"),
+			Start: t.date("start_date"),
+			End:   t.date("end_date"),
+		}
+		for i, d := range days {
+			s.Days[i] = t.flag(d)
+		}
+		if !t.bad && s.End.Before(s.Start) {
+			t.fail("end_date is before start_date")
+		}
+		if !t.unique(p.services, s.ID, "service_id") || t.bad {
+			continue
+		}
+		p.feed.Calendar = append(p.feed.Calendar, s)
+	}
+	return t.err
+}
+
+func (p *parser) parseShapes() error {
+	t, err := p.open("shapes.txt", false, "shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	p.shapes = make(map[string]bool)
+	points := make(map[string][]ShapePoint)
+	firstLine := make(map[string]int)
+	var order []string
+	for t.next() {
+		id := t.required("shape_id")
+		pt := ShapePoint{
+			Lat:      t.float("shape_pt_lat", -90, 90),
+			Lon:      t.float("shape_pt_lon", -180, 180),
+			Sequence: t.int("shape_pt_sequence", true),
+		}
+		if t.bad {
+			continue
+		}
+		if _, ok := points[id]; !ok {
+			order = append(order, id)
+			firstLine[id] = t.line
+		}
+		points[id] = append(points[id], pt)
+	}
+	for _, id := range order {
+		pts := points[id]
+		if len(pts) < 2 {
+			p.errorf(t.file, firstLine[id], "shape %q has fewer than 2 points", id)
+			continue
+		}
+		sortPoints(pts)
+		p.shapes[id] = true
+		p.feed.Shapes = append(p.feed.Shapes, Shape{ID: id, Points: pts})
+	}
+	return t.err
+}
+
+func (p *parser) parseStops() error {
+	t, err := p.open("stops.txt", true, "stop_id")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	p.stops = make(map[string]bool)
+	for t.next() {
+		s := Stop{
+			ID:            t.required("stop_id"),
+			Code:          t.str("stop_code"),
+			Name:          t.str("stop_name"),
+			LocationType:  t.intOr("location_type", 0),
+			ParentStation: t.str("parent_station"),
+		}
+		// Generic nodes and boarding areas need no name or position.
+		if s.LocationType <= 2 {
+			t.required("stop_name")
+			s.Lat = t.float("stop_lat", -90, 90)
+			s.Lon = t.float("stop_lon", -180, 180)
+		}
+		if s.LocationType < 0 || s.LocationType > 4 {
+			t.invalid("location_type", t.str("location_type"))
+		}
+		if !t.unique(p.stops, s.ID, "stop_id") || t.bad {
+			continue
+		}
+		p.feed.Stops = append(p.feed.Stops, s)
+	}
+	return t.err
+}
+
+func (p *parser) parseTrips() error {
+	t, err := p.open("trips.txt", true, "route_id", "service_id", "trip_id")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	p.tripLines = make(map[string]int)
+	_, hasDates := p.files["calendar_dates.txt"]
+	for t.next() {
+		tr := Trip{
+			ID:          t.required("trip_id"),
+			RouteID:     t.required("route_id"),
+			ServiceID:   t.required("service_id"),
+			Headsign:    t.str("trip_headsign"),
+			DirectionID: t.optInt("direction_id"),
+			BlockID:     t.str("block_id"),
+			ShapeID:     t.str("shape_id"),
+		}
+		if tr.RouteID != "" && !p.routes[tr.RouteID] {
+			t.fail("route_id %q not found in routes.txt", tr.RouteID)
+		}
+		if tr.ServiceID != "" && !hasDates && !p.services[tr.ServiceID] {
+			t.fail("service_id %q not found in calendar.txt", tr.ServiceID)
+		}
+		if tr.ShapeID != "" && !p.shapes[tr.ShapeID] {
+			t.fail("shape_id %q not found in shapes.txt", tr.ShapeID)
+		}
+		if d := tr.DirectionID; d != nil && *d != 0 && *d != 1 {
+			t.invalid("direction_id", t.str("direction_id"))
+		}
+		if _, dup := p.tripLines[tr.ID]; dup && tr.ID != "" {
+			t.fail("duplicate trip_id %q", tr.ID)
+			continue
+		}
+		if t.bad {
+			continue
+		}
+		p.tripLines[tr.ID] = t.line
+		p.feed.Trips = append(p.feed.Trips, tr)
+	}
+	return t.err
+}
+
+func (p *parser) parseStopTimes() error {
+	t, err := p.open("stop_times.txt", true, "trip_id", "stop_id", "stop_sequence")
+	if t == nil || err != nil {
+		return err
+	}
+	defer t.close()
+	type call struct {
+		st   StopTime
+		line int
+	}
+	byTrip := make(map[string][]call)
+	seqs := make(map[string]map[int]bool)
+	for t.next() {
+		st := StopTime{
+			TripID:    t.required("trip_id"),
+			StopID:    t.required("stop_id"),
+			Sequence:  t.int("stop_sequence", true),
+			Arrival:   t.timeOfDay("arrival_time"),
+			Departure: t.timeOfDay("departure_time"),
+		}
+		if _, ok := p.tripLines[st.TripID]; st.TripID != "" && !ok {
+			t.fail("trip_id %q not found in trips.txt", st.TripID)
+		}
+		if st.StopID != "" && !p.stops[st.StopID] {
+			t.fail("stop_id %q not found in stops.txt", st.StopID)
+		}
+		if st.Arrival != nil && st.Departure != nil && *st.Departure < *st.Arrival {
+			t.fail("departure_time is before arrival_time")
+		}
+		if t.bad {
+			continue
+		}
+		if seqs[st.TripID] == nil {
+			seqs[st.TripID] = make(map[int]bool)
+		}
+		if seqs[st.TripID][st.Sequence] {
+			t.fail("duplicate stop_sequence %d for trip %q", st.Sequence, st.TripID)
+			continue
+		}
+		seqs[st.TripID][st.Sequence] = true
+		byTrip[st.TripID] = append(byTrip[st.TripID], call{st, t.line})
+	}
+
+	for _, tr := range p.feed.Trips {
+		calls := byTrip[tr.ID]
+		if len(calls) < 2 {
+			p.errorf("trips.txt", p.tripLines[tr.ID], "trip %q has fewer than 2 stop times", tr.ID)
+			continue
+		}
+		first, last := calls[0], calls[0]
+		for _, c := range calls {
+			if c.st.Sequence < first.st.Sequence {
+				first = c
+			}
+			if c.st.Sequence > last.st.Sequence {
+				last = c
+			}
+			p.feed.StopTimes = append(p.feed.StopTimes, c.st)
+		}
+		for _, c := range []call{first, last} {
+			if c.st.Arrival == nil && c.st.Departure == nil {
+				p.errorf(t.file, c.line, "first and last stop of trip %q need arrival_time or departure_time", tr.ID)
+			}
+		}
+	}
+	return t.err
+}
+
+// table reads one CSV file of the feed row by row. Field accessors record a
+// validation error for the current line and mark the row bad.
+type table struct {
+	p    *parser
+	file string
+	rc   io.ReadCloser
+	r    *csv.Reader
+	cols map[string]int
+	rec  []string
+	line int
+	bad  bool
+	err  error
+}
+
+// open starts reading file, checking it has the given columns. It returns a
+// nil table when the file is missing or unusable; that is a validation error
+// if required.
+func (p *parser) open(file string, required bool, cols ...string) (*table, error) {
+	zf, ok := p.files[file]
+	if !ok {
+		if required {
+			p.errorf(file, 0, "required file is missing")
+		}
+		return nil, nil
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	r := csv.NewReader(rc)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		rc.Close()
+		if errors.Is(err, io.EOF) {
+			p.errorf(file, 1, "file is empty")
+			return nil, nil
+		}
+		p.errorf(file, 1, "%v", err)
+		return nil, nil
+	}
+	t := &table{p: p, file: file, rc: rc, r: r, cols: make(map[string]int, len(header))}
+	for i, h := range header {
+		if i == 0 {
+			h = strings.TrimPrefix(h, "\ufeff") // UTF-8 BOM
+		}
+		t.cols[strings.TrimSpace(h)] = i
+	}
+	missing := false
+	for _, c := range cols {
+		if _, ok := t.cols[c]; !ok {
+			p.errorf(file, 1, "missing required column %q", c)
+			missing = true
+		}
+	}
+	if missing {
+		rc.Close()
+		return nil, nil
+	}
+	return t, nil
+}
+
+func (t *table) close() { t.rc.Close() }
+
+// next advances to the next row. A malformed CSV line ends the file, since
+// the reader cannot resynchronize reliably.
+func (t *table) next() bool {
+	rec, err := t.r.Read()
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		t.p.errorf(t.file, pe.Line, "%v", pe.Err)
+		return false
+	}
+	if err != nil {
+		t.err = fmt.Errorf("%s: %w", t.file, err)
+		return false
+	}
+	t.rec = rec
+	t.line, _ = t.r.FieldPos(0)
+	t.bad = false
+	return true
+}
+
+func (t *table) fail(format string, args ...any) {
+	t.bad = true
+	t.p.errorf(t.file, t.line, format, args...)
+}
+
+func (t *table) invalid(col, v string) {
+	t.fail("invalid %s %q", col, v)
+}
+
+func (t *table) str(col string) string {
+	i, ok := t.cols[col]
+	if !ok || i >= len(t.rec) {
+		return ""
+	}
+	return strings.TrimSpace(t.rec[i])
+}
+
+func (t *table) required(col string) string {
+	v := t.str(col)
+	if v == "" {
+		t.fail("%s is required", col)
+	}
+	return v
+}
+
+// unique records id in seen, failing the row if it was already there. An
+// empty id is allowed once, for files where the id column is optional.
+func (t *table) unique(seen map[string]bool, id, col string) bool {
+	if id == "" && t.bad {
+		return true // already reported as missing
+	}
+	if seen[id] {
+		t.fail("duplicate %s %q", col, id)
+		return false
+	}
+	seen[id] = true
+	return true
+}
+
+func (t *table) float(col string, lo, hi float64) float64 {
+	v := t.required(col)
+	if v == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < lo || f > hi {
+		t.invalid(col, v)
+		return 0
+	}
+	return f
+}
+
+func (t *table) int(col string, required bool) int {
+	v := t.str(col)
+	if v == "" {
+		if required {
+			t.fail("%s is required", col)
+		}
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		t.invalid(col, v)
+		return 0
+	}
+	return n
+}
+
+func (t *table) intOr(col string, def int) int {
+	if t.str(col) == "" {
+		return def
+	}
+	return t.int(col, false)
+}
+
+func (t *table) optInt(col string) *int {
+	if t.str(col) == "" {
+		return nil
+	}
+	n := t.int(col, false)
+	return &n
+}
+
+func (t *table) flag(col string) bool {
+	switch v := t.str(col); v {
+	case "0":
+		return false
+	case "1":
+		return true
+	default:
+		t.invalid(col, v)
+		return false
+	}
+}
+
+func (t *table) date(col string) time.Time {
+	v := t.required(col)
+	if v == "" {
+		return time.Time{}
+	}
+	d, err := time.Parse("20060102", v)
+	if err != nil {
+		t.invalid(col, v)
+	}
+	return d
+}
+
+// timeOfDay parses H:MM:SS into seconds. Hours may exceed 23 for trips that
+// run past midnight of their service day.
+func (t *table) timeOfDay(col string) *int {
+	v := t.str(col)
+	if v == "" {
+		return nil
+	}
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		t.invalid(col, v)
+		return nil
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	s, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || h < 0 || m < 0 || m > 59 || s < 0 || s > 59 || len(parts[1]) != 2 || len(parts[2]) != 2 {
+		t.invalid(col, v)
+		return nil
+	}
+	secs := h*3600 + m*60 + s
+	return &secs
+}
+
+func sortPoints(pts []ShapePoint) {
+	sort.SliceStable(pts, func(i, j int) bool { return pts[i].Sequence < pts[j].Sequence })
+}
@@ -0,0 +1,319 @@
+package gtfsrt
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	// Embedded so the agency timezone resolves on images without tzdata.
+	_ "time/tzdata"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// matchWindow is how far off schedule a bus may run and still be matched
+	// to a trip.
+	matchWindow = 30 * time.Minute
+	// stoppedRadius is how close to its current stop a bus counts as
+	// STOPPED_AT rather than IN_TRANSIT_TO.
+	stoppedRadius = 50.0
+)
+
+// Feed is one encoded feed of a snapshot.
+type Feed struct {
+	Message *FeedMessage
+	Proto   []byte
+}
+
+// Snapshot holds both feeds built from the same read of the live state.
+type Snapshot struct {
+	Built            time.Time
+	VehiclePositions Feed
+	TripUpdates      Feed
+}
+
+// Builder builds snapshots and caches the latest one for ttl, so any number
+// of pollers cost one Redis and Postgres round per ttl on each instance.
+type Builder struct {
+	redis      *redisclient.Client
+	staleAfter time.Duration
+	ttl        time.Duration
+
+	// mu is held while building, so concurrent requests for an expired
+	// snapshot wait for one build instead of starting their own.
+	mu   sync.Mutex
+	snap *Snapshot
+}
+
+// NewBuilder creates a builder. Vehicles whose last fix is older than
+// staleAfter are left out of the feeds.
+func NewBuilder(r *redisclient.Client, staleAfter, ttl time.Duration) *Builder {
+	return &Builder{redis: r, staleAfter: staleAfter, ttl: ttl}
+}
+
+// TTL is how long a snapshot is served before it is rebuilt.
+func (b *Builder) TTL() time.Duration { return b.ttl }
+
+// Snapshot returns the cached snapshot, building a new one if it has expired.
+func (b *Builder) Snapshot(ctx context.Context) (*Snapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.snap != nil && time.Since(b.snap.Built) < b.ttl {
+		return b.snap, nil
+	}
+	snap, err := b.build(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	b.snap = snap
+	return snap, nil
+}
+
+// liveFix is a vehicle:<id>:last hash.
+type liveFix struct {
+	busID    string
+	lat, lon float64
+	ts       int64
+	speedKph float64
+	heading  *float64
+}
+
+func (b *Builder) build(ctx context.Context, now time.Time) (*Snapshot, error) {
+	fixes, err := b.liveFixes(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := db.FeedLocation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var trips []db.VehicleTrip
+	if len(fixes) > 0 {
+		in := make([]db.VehicleFix, len(fixes))
+		for i, f := range fixes {
+			in[i] = scheduleFix(f, loc)
+		}
+		if trips, err = db.MatchVehicleTrips(ctx, in, matchWindow); err != nil {
+			return nil, err
+		}
+	}
+	trips = dedupeTrips(trips)
+
+	var tripIDs []string
+	for _, t := range trips {
+		if t.TripGTFSID != nil {
+			tripIDs = append(tripIDs, *t.TripGTFSID)
+		}
+	}
+	schedules := map[string][]db.ScheduledStop{}
+	if len(tripIDs) > 0 {
+		if schedules, err = db.TripStopTimes(ctx, tripIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	byBus := make(map[string]*liveFix, len(fixes))
+	for i := range fixes {
+		byBus[fixes[i].busID] = &fixes[i]
+	}
+	header := FeedHeader{GTFSRealtimeVersion: Version, Incrementality: FullDataset, Timestamp: uint64(now.Unix())}
+	vp := &FeedMessage{Header: header, Entity: []FeedEntity{}}
+	tu := &FeedMessage{Header: header, Entity: []FeedEntity{}}
+	for i := range trips {
+		t := &trips[i]
+		f := byBus[t.BusID]
+		vp.Entity = append(vp.Entity, FeedEntity{ID: t.BusID, Vehicle: vehiclePosition(t, f)})
+		if u := tripUpdate(t, f, schedules[deref(t.TripGTFSID)], loc); u != nil {
+			tu.Entity = append(tu.Entity, FeedEntity{ID: t.BusID, TripUpdate: u})
+		}
+	}
+
+	return &Snapshot{
+		Built:            now,
+		VehiclePositions: Feed{Message: vp, Proto: vp.Marshal()},
+		TripUpdates:      Feed{Message: tu, Proto: tu.Marshal()},
+	}, nil
+}
+
+// liveFixes reads the last fix of every member of live:vehicles, skipping
+// stale ones.
+func (b *Builder) liveFixes(ctx context.Context, now time.Time) ([]liveFix, error) {
+	rdb := b.redis.RDB()
+	ids, err := rdb.ZRange(ctx, "live:vehicles", 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	lasts := make([]*redis.MapStringStringCmd, len(ids))
+	pipe := rdb.Pipeline()
+	for i, id := range ids {
+		lasts[i] = pipe.HGetAll(ctx, "vehicle:"+id+":last")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-b.staleAfter).Unix()
+	out := make([]liveFix, 0, len(ids))
+	for i, id := range ids {
+		last := lasts[i].Val()
+		ts, err := strconv.ParseInt(last["ts"], 10, 64)
+		if err != nil || ts < cutoff {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(last["lat"], 64)
+		lon, errLon := strconv.ParseFloat(last["lon"], 64)
+		if errLat != nil || errLon != nil {
+			continue
+		}
+		f := liveFix{busID: id, lat: lat, lon: lon, ts: ts}
+		f.speedKph, _ = strconv.ParseFloat(last["speed"], 64)
+		if h, err := strconv.ParseFloat(last["heading"], 64); err == nil {
+			f.heading = &h
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// serviceDayStart is when GTFS times of the service day date count from:
+// noon minus 12h, which is midnight except on DST changes.
+func serviceDayStart(date time.Time, loc *time.Location) time.Time {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 12, 0, 0, 0, loc).Add(-12 * time.Hour)
+}
+
+func scheduleFix(f liveFix, loc *time.Location) db.VehicleFix {
+	ts := time.Unix(f.ts, 0)
+	y, m, d := ts.In(loc).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return db.VehicleFix{
+		BusID:    f.busID,
+		Lat:      f.lat,
+		Lon:      f.lon,
+		Day:      day,
+		Secs:     int(ts.Sub(serviceDayStart(day, loc)).Seconds()),
+		PrevSecs: int(ts.Sub(serviceDayStart(day.AddDate(0, 0, -1), loc)).Seconds()),
+	}
+}
+
+// dedupeTrips keeps one bus per trip and service day, the one closest to its
+// matched stop; the others are kept without a trip. Buses are sorted by id so
+// the feeds are stable between builds.
+func dedupeTrips(trips []db.VehicleTrip) []db.VehicleTrip {
+	sort.Slice(trips, func(i, j int) bool { return trips[i].BusID < trips[j].BusID })
+	best := make(map[string]int)
+	for i, t := range trips {
+		if t.TripGTFSID == nil {
+			continue
+		}
+		key := *t.TripGTFSID + "/" + t.ServiceDate.Format("20060102")
+		j, seen := best[key]
+		if !seen || *t.StopDistance < *trips[j].StopDistance {
+			best[key] = i
+		}
+	}
+	for i := range trips {
+		t := &trips[i]
+		if t.TripGTFSID == nil {
+			continue
+		}
+		if best[*t.TripGTFSID+"/"+t.ServiceDate.Format("20060102")] != i {
+			t.TripGTFSID, t.DirectionID, t.ServiceDate, t.StopGTFSID, t.StopSequence, t.StopDistance, t.Delay = nil, nil, nil, nil, nil, nil, nil
+		}
+	}
+	return trips
+}
+
+func tripDescriptor(t *db.VehicleTrip) *TripDescriptor {
+	if t.TripGTFSID == nil {
+		if t.RouteGTFSID == nil {
+			return nil
+		}
+		return &TripDescriptor{RouteID: *t.RouteGTFSID}
+	}
+	td := &TripDescriptor{
+		TripID:    *t.TripGTFSID,
+		RouteID:   deref(t.RouteGTFSID),
+		StartDate: t.ServiceDate.Format("20060102"),
+	}
+	if t.DirectionID != nil {
+		d := uint32(*t.DirectionID)
+		td.DirectionID = &d
+	}
+	return td
+}
+
+func vehicleDescriptor(t *db.VehicleTrip) *VehicleDescriptor {
+	return &VehicleDescriptor{ID: t.BusID, Label: deref(t.VehicleCode), LicensePlate: deref(t.RegistrationNo)}
+}
+
+func vehiclePosition(t *db.VehicleTrip, f *liveFix) *VehiclePosition {
+	speed := float32(f.speedKph / 3.6)
+	vp := &VehiclePosition{
+		Trip:      tripDescriptor(t),
+		Vehicle:   vehicleDescriptor(t),
+		Position:  &Position{Latitude: float32(f.lat), Longitude: float32(f.lon), Speed: &speed},
+		Timestamp: uint64(f.ts),
+	}
+	if f.heading != nil {
+		h := float32(*f.heading)
+		vp.Position.Bearing = &h
+	}
+	if t.TripGTFSID != nil {
+		seq := uint32(*t.StopSequence)
+		status := InTransitTo
+		if *t.StopDistance <= stoppedRadius {
+			status = StoppedAt
+		}
+		vp.CurrentStopSequence, vp.StopID, vp.CurrentStatus = &seq, *t.StopGTFSID, &status
+	}
+	return vp
+}
+
+// tripUpdate predicts the remaining calls of a matched trip by carrying the
+// delay observed at the bus's current stop forward to every later timed
+// stop. Returns nil for buses without a trip.
+func tripUpdate(t *db.VehicleTrip, f *liveFix, schedule []db.ScheduledStop, loc *time.Location) *TripUpdate {
+	if t.TripGTFSID == nil {
+		return nil
+	}
+	delay := int32(*t.Delay)
+	start := serviceDayStart(*t.ServiceDate, loc).Unix()
+	event := func(secs *int) *StopTimeEvent {
+		if secs == nil {
+			return nil
+		}
+		d := delay
+		return &StopTimeEvent{Delay: &d, Time: start + int64(*secs) + int64(delay)}
+	}
+
+	u := &TripUpdate{Trip: *tripDescriptor(t), Vehicle: vehicleDescriptor(t), Timestamp: uint64(f.ts), Delay: &delay}
+	for _, s := range schedule {
+		if s.Sequence < *t.StopSequence || (s.Arrival == nil && s.Departure == nil) {
+			continue
+		}
+		seq := uint32(s.Sequence)
+		u.StopTimeUpdate = append(u.StopTimeUpdate, StopTimeUpdate{
+			StopSequence: &seq,
+			StopID:       s.StopGTFSID,
+			Arrival:      event(s.Arrival),
+			Departure:    event(s.Departure),
+		})
+	}
+	if len(u.StopTimeUpdate) == 0 {
+		return nil
+	}
+	return u
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,268 @@
+// Package gtfsrt builds GTFS-Realtime VehiclePositions and TripUpdates feeds
+// from the live vehicle state in Redis and the imported GTFS schedule.
+//
+// Only the subset of gtfs-realtime.proto the backend fills in is modelled.
+// Messages are encoded by hand with protowire, field numbers as in
+// https://gtfs.org/realtime/reference/, and carry protojson-style JSON tags
+// for the ?format=json debug output.
+package gtfsrt
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Version is the gtfs_realtime_version of the feeds.
+const Version = "2.0"
+
+type FeedMessage struct {
+	Header FeedHeader   `json:"header"`
+	Entity []FeedEntity `json:"entity"`
+}
+
+type FeedHeader struct {
+	GTFSRealtimeVersion string         `json:"gtfsRealtimeVersion"`
+	Incrementality      Incrementality `json:"incrementality"`
+	Timestamp           uint64         `json:"timestamp"`
+}
+
+type Incrementality int32
+
+const FullDataset Incrementality = 0
+
+func (i Incrementality) MarshalText() ([]byte, error) {
+	return []byte("FULL_DATASET"), nil
+}
+
+// FeedEntity holds exactly one of TripUpdate and Vehicle.
+type FeedEntity struct {
+	ID         string           `json:"id"`
+	TripUpdate *TripUpdate      `json:"tripUpdate,omitempty"`
+	Vehicle    *VehiclePosition `json:"vehicle,omitempty"`
+}
+
+type TripDescriptor struct {
+	TripID      string  `json:"tripId,omitempty"`
+	RouteID     string  `json:"routeId,omitempty"`
+	DirectionID *uint32 `json:"directionId,omitempty"`
+	// StartDate is the service day, YYYYMMDD.
+	StartDate string `json:"startDate,omitempty"`
+}
+
+type VehicleDescriptor struct {
+	ID           string `json:"id,omitempty"`
+	Label        string `json:"label,omitempty"`
+	LicensePlate string `json:"licensePlate,omitempty"`
+}
+
+type Position struct {
+	Latitude  float32  `json:"latitude"`
+	Longitude float32  `json:"longitude"`
+	Bearing   *float32 `json:"bearing,omitempty"`
+	// Speed is in meters per second.
+	Speed *float32 `json:"speed,omitempty"`
+}
+
+type VehicleStopStatus int32
+
+const (
+	IncomingAt  VehicleStopStatus = 0
+	StoppedAt   VehicleStopStatus = 1
+	InTransitTo VehicleStopStatus = 2
+)
+
+func (s VehicleStopStatus) MarshalText() ([]byte, error) {
+	switch s {
+	case StoppedAt:
+		return []byte("STOPPED_AT"), nil
+	case InTransitTo:
+		return []byte("IN_TRANSIT_TO"), nil
+	}
+	return []byte("INCOMING_AT"), nil
+}
+
+type VehiclePosition struct {
+	Trip                *TripDescriptor    `json:"trip,omitempty"`
+	Vehicle             *VehicleDescriptor `json:"vehicle,omitempty"`
+	Position            *Position          `json:"position,omitempty"`
+	CurrentStopSequence *uint32            `json:"currentStopSequence,omitempty"`
+	StopID              string             `json:"stopId,omitempty"`
+	CurrentStatus       *VehicleStopStatus `json:"currentStatus,omitempty"`
+	Timestamp           uint64             `json:"timestamp,omitempty"`
+}
+
+type TripUpdate struct {
+	Trip           TripDescriptor     `json:"trip"`
+	Vehicle        *VehicleDescriptor `json:"vehicle,omitempty"`
+	StopTimeUpdate []StopTimeUpdate   `json:"stopTimeUpdate,omitempty"`
+	Timestamp      uint64             `json:"timestamp,omitempty"`
+	Delay          *int32             `json:"delay,omitempty"`
+}
+
+type StopTimeUpdate struct {
+	StopSequence *uint32        `json:"stopSequence,omitempty"`
+	StopID       string         `json:"stopId,omitempty"`
+	Arrival      *StopTimeEvent `json:"arrival,omitempty"`
+	Departure    *StopTimeEvent `json:"departure,omitempty"`
+}
+
+// StopTimeEvent is a predicted arrival or departure: Time in unix seconds and
+// Delay in seconds against the schedule.
+type StopTimeEvent struct {
+	Delay *int32 `json:"delay,omitempty"`
+	Time  int64  `json:"time,omitempty"`
+}
+
+// Marshal encodes m in the protobuf wire format.
+func (m *FeedMessage) Marshal() []byte {
+	b := appendMessage(nil, 1, m.Header.appendTo)
+	for i := range m.Entity {
+		b = appendMessage(b, 2, m.Entity[i].appendTo)
+	}
+	return b
+}
+
+func (h *FeedHeader) appendTo(b []byte) []byte {
+	b = appendString(b, 1, h.GTFSRealtimeVersion)
+	b = appendVarint(b, 2, uint64(h.Incrementality))
+	return appendUint(b, 3, h.Timestamp)
+}
+
+func (e *FeedEntity) appendTo(b []byte) []byte {
+	b = appendString(b, 1, e.ID)
+	if e.TripUpdate != nil {
+		b = appendMessage(b, 3, e.TripUpdate.appendTo)
+	}
+	if e.Vehicle != nil {
+		b = appendMessage(b, 4, e.Vehicle.appendTo)
+	}
+	return b
+}
+
+func (t *TripDescriptor) appendTo(b []byte) []byte {
+	b = appendString(b, 1, t.TripID)
+	b = appendString(b, 3, t.StartDate)
+	b = appendString(b, 5, t.RouteID)
+	if t.DirectionID != nil {
+		b = appendVarint(b, 6, uint64(*t.DirectionID))
+	}
+	return b
+}
+
+func (v *VehicleDescriptor) appendTo(b []byte) []byte {
+	b = appendString(b, 1, v.ID)
+	b = appendString(b, 2, v.Label)
+	return appendString(b, 3, v.LicensePlate)
+}
+
+func (p *Position) appendTo(b []byte) []byte {
+	b = appendFloat(b, 1, p.Latitude)
+	b = appendFloat(b, 2, p.Longitude)
+	if p.Bearing != nil {
+		b = appendFloat(b, 3, *p.Bearing)
+	}
+	if p.Speed != nil {
+		b = appendFloat(b, 5, *p.Speed)
+	}
+	return b
+}
+
+func (v *VehiclePosition) appendTo(b []byte) []byte {
+	if v.Trip != nil {
+		b = appendMessage(b, 1, v.Trip.appendTo)
+	}
+	if v.Position != nil {
+		b = appendMessage(b, 2, v.Position.appendTo)
+	}
+	if v.CurrentStopSequence != nil {
+		b = appendVarint(b, 3, uint64(*v.CurrentStopSequence))
+	}
+	if v.CurrentStatus != nil {
+		b = appendVarint(b, 4, uint64(*v.CurrentStatus))
+	}
+	b = appendUint(b, 5, v.Timestamp)
+	b = appendString(b, 7, v.StopID)
+	if v.Vehicle != nil {
+		b = appendMessage(b, 8, v.Vehicle.appendTo)
+	}
+	return b
+}
+
+func (u *TripUpdate) appendTo(b []byte) []byte {
+	b = appendMessage(b, 1, u.Trip.appendTo)
+	for i := range u.StopTimeUpdate {
+		b = appendMessage(b, 2, u.StopTimeUpdate[i].appendTo)
+	}
+	if u.Vehicle != nil {
+		b = appendMessage(b, 3, u.Vehicle.appendTo)
+	}
+	b = appendUint(b, 4, u.Timestamp)
+	if u.Delay != nil {
+		b = appendInt(b, 5, int64(*u.Delay))
+	}
+	return b
+}
+
+func (s *StopTimeUpdate) appendTo(b []byte) []byte {
+	if s.StopSequence != nil {
+		b = appendVarint(b, 1, uint64(*s.StopSequence))
+	}
+	if s.Arrival != nil {
+		b = appendMessage(b, 2, s.Arrival.appendTo)
+	}
+	if s.Departure != nil {
+		b = appendMessage(b, 3, s.Departure.appendTo)
+	}
+	return appendString(b, 4, s.StopID)
+}
+
+func (e *StopTimeEvent) appendTo(b []byte) []byte {
+	if e.Delay != nil {
+		b = appendInt(b, 1, int64(*e.Delay))
+	}
+	if e.Time != 0 {
+		b = appendInt(b, 2, e.Time)
+	}
+	return b
+}
+
+// appendMessage writes a length-delimited submessage built by fn.
+func appendMessage(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+// appendString skips empty strings, which all optional string fields here
+// treat as unset.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendUint skips zero, used for timestamps where 0 means unset.
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(b, num, v)
+}
+
+// appendInt encodes int32 and int64 fields; negative values take ten bytes
+// as protobuf specifies.
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	return appendVarint(b, num, uint64(v))
+}
+
+func appendFloat(b []byte, num protowire.Number, f float32) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(f))
+}
@@ -0,0 +1,348 @@
+package gtfsrt
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TestMarshal decodes Marshal output with protowire, using the field numbers
+// of gtfs-realtime.proto, and expects the message it was built from.
+func TestMarshal(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	i32 := func(v int32) *int32 { return &v }
+	f32 := func(v float32) *float32 { return &v }
+	status := InTransitTo
+
+	want := &FeedMessage{
+		Header: FeedHeader{GTFSRealtimeVersion: Version, Incrementality: FullDataset, Timestamp: 1719930000},
+		Entity: []FeedEntity{
+			{
+				ID: "0b2b3646-1f6e-4fe1-b300-91a8b6a7f7d9",
+				Vehicle: &VehiclePosition{
+					Trip:                &TripDescriptor{TripID: "t1", RouteID: "r1", DirectionID: u32(1), StartDate: "20240702"},
+					Vehicle:             &VehicleDescriptor{ID: "0b2b3646-1f6e-4fe1-b300-91a8b6a7f7d9", Label: "BUS-12", LicensePlate: "KA01AB1234"},
+					Position:            &Position{Latitude: 12.9716, Longitude: -77.5946, Bearing: f32(145), Speed: f32(9.5)},
+					CurrentStopSequence: u32(3),
+					StopID:              "s3",
+					CurrentStatus:       &status,
+					Timestamp:           1719929990,
+				},
+			},
+			{
+				ID: "t1",
+				TripUpdate: &TripUpdate{
+					Trip:    TripDescriptor{TripID: "t1", RouteID: "r1", DirectionID: u32(0), StartDate: "20240702"},
+					Vehicle: &VehicleDescriptor{ID: "0b2b3646-1f6e-4fe1-b300-91a8b6a7f7d9"},
+					StopTimeUpdate: []StopTimeUpdate{
+						{StopSequence: u32(4), StopID: "s4", Arrival: &StopTimeEvent{Delay: i32(-90), Time: 1719930120}},
+						{StopSequence: u32(5), StopID: "s5", Arrival: &StopTimeEvent{Delay: i32(30), Time: 1719930400}, Departure: &StopTimeEvent{Delay: i32(0), Time: 1719930430}},
+					},
+					Timestamp: 1719929990,
+					Delay:     i32(-90),
+				},
+			},
+		},
+	}
+
+	got := decodeFeedMessage(t, want.Marshal())
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(want)
+		t.Errorf("decoded feed differs\n got: %s\nwant: %s", g, w)
+	}
+
+	// int32 fields sign-extend negative values to a ten-byte varint
+	ev := (&StopTimeEvent{Delay: i32(-1)}).appendTo(nil)
+	if want := 1 + 10; len(ev) != want {
+		t.Errorf("StopTimeEvent with delay -1 is %d bytes, want %d", len(ev), want)
+	}
+}
+
+// field is one decoded field of a message.
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	v   uint64
+	b   []byte
+}
+
+func fields(t *testing.T, b []byte) []field {
+	t.Helper()
+	var out []field
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.v = uint64(v)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", num, typ)
+		}
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		out = append(out, f)
+	}
+	return out
+}
+
+func (f field) want(t *testing.T, typ protowire.Type) {
+	t.Helper()
+	if f.typ != typ {
+		t.Fatalf("field %d: wire type %d, want %d", f.num, f.typ, typ)
+	}
+}
+
+func (f field) bytes(t *testing.T) []byte {
+	t.Helper()
+	f.want(t, protowire.BytesType)
+	return f.b
+}
+
+func (f field) str(t *testing.T) string { return string(f.bytes(t)) }
+
+func (f field) varint(t *testing.T) uint64 {
+	t.Helper()
+	f.want(t, protowire.VarintType)
+	return f.v
+}
+
+// int32 reads an int32 field, which protobuf sign-extends to 64 bits.
+func (f field) int32(t *testing.T) int32 {
+	t.Helper()
+	v := int64(f.varint(t))
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		t.Fatalf("field %d: %d overflows int32", f.num, v)
+	}
+	return int32(v)
+}
+
+func (f field) uint32(t *testing.T) uint32 { return uint32(f.varint(t)) }
+
+func (f field) float(t *testing.T) float32 {
+	t.Helper()
+	f.want(t, protowire.Fixed32Type)
+	return math.Float32frombits(uint32(f.v))
+}
+
+func unexpected(t *testing.T, msg string, f field) {
+	t.Helper()
+	t.Errorf("%s: unexpected field %d", msg, f.num)
+}
+
+func decodeFeedMessage(t *testing.T, b []byte) *FeedMessage {
+	t.Helper()
+	m := &FeedMessage{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			m.Header = decodeFeedHeader(t, f.bytes(t))
+		case 2:
+			m.Entity = append(m.Entity, decodeFeedEntity(t, f.bytes(t)))
+		default:
+			unexpected(t, "FeedMessage", f)
+		}
+	}
+	return m
+}
+
+func decodeFeedHeader(t *testing.T, b []byte) FeedHeader {
+	t.Helper()
+	var h FeedHeader
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			h.GTFSRealtimeVersion = f.str(t)
+		case 2:
+			h.Incrementality = Incrementality(f.varint(t))
+		case 3:
+			h.Timestamp = f.varint(t)
+		default:
+			unexpected(t, "FeedHeader", f)
+		}
+	}
+	return h
+}
+
+func decodeFeedEntity(t *testing.T, b []byte) FeedEntity {
+	t.Helper()
+	var e FeedEntity
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			e.ID = f.str(t)
+		case 3:
+			e.TripUpdate = decodeTripUpdate(t, f.bytes(t))
+		case 4:
+			e.Vehicle = decodeVehiclePosition(t, f.bytes(t))
+		default:
+			unexpected(t, "FeedEntity", f)
+		}
+	}
+	return e
+}
+
+func decodeTripDescriptor(t *testing.T, b []byte) *TripDescriptor {
+	t.Helper()
+	d := &TripDescriptor{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			d.TripID = f.str(t)
+		case 3:
+			d.StartDate = f.str(t)
+		case 5:
+			d.RouteID = f.str(t)
+		case 6:
+			v := f.uint32(t)
+			d.DirectionID = &v
+		default:
+			unexpected(t, "TripDescriptor", f)
+		}
+	}
+	return d
+}
+
+func decodeVehicleDescriptor(t *testing.T, b []byte) *VehicleDescriptor {
+	t.Helper()
+	d := &VehicleDescriptor{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			d.ID = f.str(t)
+		case 2:
+			d.Label = f.str(t)
+		case 3:
+			d.LicensePlate = f.str(t)
+		default:
+			unexpected(t, "VehicleDescriptor", f)
+		}
+	}
+	return d
+}
+
+func decodePosition(t *testing.T, b []byte) *Position {
+	t.Helper()
+	p := &Position{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			p.Latitude = f.float(t)
+		case 2:
+			p.Longitude = f.float(t)
+		case 3:
+			v := f.float(t)
+			p.Bearing = &v
+		case 5:
+			v := f.float(t)
+			p.Speed = &v
+		default:
+			unexpected(t, "Position", f)
+		}
+	}
+	return p
+}
+
+func decodeVehiclePosition(t *testing.T, b []byte) *VehiclePosition {
+	t.Helper()
+	v := &VehiclePosition{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			v.Trip = decodeTripDescriptor(t, f.bytes(t))
+		case 2:
+			v.Position = decodePosition(t, f.bytes(t))
+		case 3:
+			seq := f.uint32(t)
+			v.CurrentStopSequence = &seq
+		case 4:
+			s := VehicleStopStatus(f.varint(t))
+			v.CurrentStatus = &s
+		case 5:
+			v.Timestamp = f.varint(t)
+		case 7:
+			v.StopID = f.str(t)
+		case 8:
+			v.Vehicle = decodeVehicleDescriptor(t, f.bytes(t))
+		default:
+			unexpected(t, "VehiclePosition", f)
+		}
+	}
+	return v
+}
+
+func decodeTripUpdate(t *testing.T, b []byte) *TripUpdate {
+	t.Helper()
+	u := &TripUpdate{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			u.Trip = *decodeTripDescriptor(t, f.bytes(t))
+		case 2:
+			u.StopTimeUpdate = append(u.StopTimeUpdate, decodeStopTimeUpdate(t, f.bytes(t)))
+		case 3:
+			u.Vehicle = decodeVehicleDescriptor(t, f.bytes(t))
+		case 4:
+			u.Timestamp = f.varint(t)
+		case 5:
+			d := f.int32(t)
+			u.Delay = &d
+		default:
+			unexpected(t, "TripUpdate", f)
+		}
+	}
+	return u
+}
+
+func decodeStopTimeUpdate(t *testing.T, b []byte) StopTimeUpdate {
+	t.Helper()
+	var s StopTimeUpdate
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			seq := f.uint32(t)
+			s.StopSequence = &seq
+		case 2:
+			s.Arrival = decodeStopTimeEvent(t, f.bytes(t))
+		case 3:
+			s.Departure = decodeStopTimeEvent(t, f.bytes(t))
+		case 4:
+			s.StopID = f.str(t)
+		default:
+			unexpected(t, "StopTimeUpdate", f)
+		}
+	}
+	return s
+}
+
+func decodeStopTimeEvent(t *testing.T, b []byte) *StopTimeEvent {
+	t.Helper()
+	e := &StopTimeEvent{}
+	for _, f := range fields(t, b) {
+		switch f.num {
+		case 1:
+			d := f.int32(t)
+			e.Delay = &d
+		case 2:
+			e.Time = int64(f.varint(t))
+		default:
+			unexpected(t, "StopTimeEvent", f)
+		}
+	}
+	return e
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/auth"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// DevicesHandler issues the credentials on-board devices use for ingest.
+type DevicesHandler struct {
+	logger   *zap.Logger
+	jwt      *auth.JWTManager
+	denylist *auth.Denylist
+	tokenTTL time.Duration
+}
+
+func NewDevicesHandler(logger *zap.Logger, jwtMgr *auth.JWTManager, denylist *auth.Denylist, tokenTTL time.Duration) *DevicesHandler {
+	return &DevicesHandler{logger: logger, jwt: jwtMgr, denylist: denylist, tokenTTL: tokenTTL}
+}
+
+type DeviceTokenResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"tokenType"`
+	BusID     string    `json:"busId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// IssueToken mints a device token bound to a registered bus. The token is
+// only accepted by the ingest endpoints and only for that bus.
+//
+//	POST /api/v1/buses/:id/token
+func (h *DevicesHandler) IssueToken(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	bus, err := db.GetBus(c.Request.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("get bus failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	token, exp, err := h.jwt.GenerateDeviceToken(bus.ID, h.tokenTTL)
+	if err != nil {
+		h.logger.Error("issue device token failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, DeviceTokenResponse{Token: token, TokenType: "Bearer", BusID: bus.ID, ExpiresAt: exp})
+}
+
+// RevokeTokens invalidates every device token issued so far for the bus, e.g.
+// when a device is lost or replaced. Issue a new token afterwards.
+//
+//	DELETE /api/v1/buses/:id/token
+func (h *DevicesHandler) RevokeTokens(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := h.denylist.RevokeAll(c.Request.Context(), id, h.tokenTTL); err != nil {
+		h.logger.Error("revoke device tokens failed", zap.String("bus", id), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
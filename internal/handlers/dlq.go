@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	positionsStream = "stream:positions"
+	dlqStream       = "stream:positions:dlq"
+	dlqFieldPrefix  = "dlq"
+)
+
+// DLQHandler exposes the positions dead-letter queue filled by the worker.
+type DLQHandler struct {
+	redis  *redisclient.Client
+	logger *zap.Logger
+}
+
+func NewDLQHandler(r *redisclient.Client, logger *zap.Logger) *DLQHandler {
+	return &DLQHandler{redis: r, logger: logger}
+}
+
+type DLQEntry struct {
+	ID     string                 `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// List returns dead-lettered entries oldest first.
+//
+//	GET /api/v1/admin/dlq?limit=&after=
+//
+// Pass nextAfter from a previous page as after to continue.
+func (h *DLQHandler) List(c *gin.Context) {
+	limit := int64(100)
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, 1000)
+	}
+	start := "-"
+	if after := c.Query("after"); after != "" {
+		// exclusive range start
+		start = "(" + after
+	}
+	msgs, err := h.redis.RDB().XRangeN(c.Request.Context(), dlqStream, start, "+", limit).Result()
+	if err != nil {
+		h.logger.Error("dlq list failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	total, _ := h.redis.RDB().XLen(c.Request.Context(), dlqStream).Result()
+
+	entries := make([]DLQEntry, len(msgs))
+	for i, m := range msgs {
+		entries[i] = DLQEntry{ID: m.ID, Values: m.Values}
+	}
+	var nextAfter string
+	if int64(len(msgs)) == limit {
+		nextAfter = msgs[len(msgs)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "entries": entries, "nextAfter": nextAfter})
+}
+
+// Replay re-queues a dead-lettered entry onto stream:positions and removes it
+// from the DLQ.
+//
+//	POST /api/v1/admin/dlq/:id/replay
+func (h *DLQHandler) Replay(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	msgs, err := h.redis.RDB().XRange(ctx, dlqStream, id, id).Result()
+	if err != nil {
+		h.logger.Error("dlq lookup failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if len(msgs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "entry not found"})
+		return
+	}
+
+	values := make(map[string]interface{}, len(msgs[0].Values))
+	for k, v := range msgs[0].Values {
+		if !strings.HasPrefix(k, dlqFieldPrefix) {
+			values[k] = v
+		}
+	}
+	pipe := h.redis.RDB().TxPipeline()
+	newID := pipe.XAdd(ctx, &redis.XAddArgs{Stream: positionsStream, Values: values})
+	pipe.XDel(ctx, dlqStream, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		h.logger.Error("dlq replay failed", zap.String("id", id), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "replay failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "streamId": newID.Val()})
+}
+
+// Delete removes a single dead-lettered entry.
+//
+//	DELETE /api/v1/admin/dlq/:id
+func (h *DLQHandler) Delete(c *gin.Context) {
+	n, err := h.redis.RDB().XDel(c.Request.Context(), dlqStream, c.Param("id")).Result()
+	if err != nil {
+		h.logger.Error("dlq delete failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "entry not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Purge drops every dead-lettered entry.
+//
+//	DELETE /api/v1/admin/dlq
+func (h *DLQHandler) Purge(c *gin.Context) {
+	n, err := h.redis.RDB().XTrimMaxLen(c.Request.Context(), dlqStream, 0).Result()
+	if err != nil {
+		h.logger.Error("dlq purge failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "purge failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/eta"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultETALimit = 10
+	maxETALimit     = 100
+)
+
+// ETAHandler serves arrival predictions.
+type ETAHandler struct {
+	logger    *zap.Logger
+	estimator *eta.Estimator
+}
+
+func NewETAHandler(logger *zap.Logger, estimator *eta.Estimator) *ETAHandler {
+	return &ETAHandler{logger: logger, estimator: estimator}
+}
+
+// ETAResponse is one predicted arrival. Seconds are from generatedAt;
+// etaMinSeconds and etaMaxSeconds bound the estimate.
+type ETAResponse struct {
+	EtaSeconds     int64     `json:"etaSeconds"`
+	EtaMinSeconds  int64     `json:"etaMinSeconds"`
+	EtaMaxSeconds  int64     `json:"etaMaxSeconds"`
+	ArrivalAt      time.Time `json:"arrivalAt"`
+	DistanceMeters float64   `json:"distanceMeters"`
+}
+
+type StopArrivalResponse struct {
+	BusID       string    `json:"busId"`
+	VehicleCode *string   `json:"vehicleCode"`
+	LastFixAt   time.Time `json:"lastFixAt"`
+	ETAResponse
+}
+
+type VehicleStopETAResponse struct {
+	StopID string `json:"stopId"`
+	Name   string `json:"name"`
+	Seq    *int   `json:"seq"`
+	ETAResponse
+}
+
+func toETAResponse(e *eta.StopETA, now time.Time) ETAResponse {
+	return ETAResponse{
+		EtaSeconds:     int64(e.ETA.Seconds()),
+		EtaMinSeconds:  int64(e.Min.Seconds()),
+		EtaMaxSeconds:  int64(e.Max.Seconds()),
+		ArrivalAt:      now.Add(e.ETA).UTC(),
+		DistanceMeters: math.Round(e.Distance),
+	}
+}
+
+// StopArrivals predicts the next arrivals at a stop, soonest first.
+//
+//	GET /api/v1/stops/:id/arrivals?limit=
+func (h *ETAHandler) StopArrivals(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid stop id"})
+		return
+	}
+	limit, ok := etaLimit(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	stop, err := db.GetStop(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("get stop failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	now := time.Now()
+	arrivals, err := h.estimator.Stop(ctx, stop, limit)
+	if err != nil {
+		h.logger.Error("stop eta failed", zap.String("stopId", id), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "eta failed"})
+		return
+	}
+	out := make([]StopArrivalResponse, len(arrivals))
+	for i := range arrivals {
+		a := &arrivals[i]
+		out[i] = StopArrivalResponse{BusID: a.Bus.ID, VehicleCode: a.Bus.VehicleCode, LastFixAt: a.FixAt.UTC(), ETAResponse: toETAResponse(&a.StopETA, now)}
+	}
+	c.JSON(http.StatusOK, gin.H{"stopId": stop.ID, "routeId": stop.RouteID, "generatedAt": now.UTC(), "arrivals": out})
+}
+
+// VehicleETA predicts when a vehicle reaches its next stops, in route order.
+//
+//	GET /api/v1/vehicles/:id/eta?limit=
+func (h *ETAHandler) VehicleETA(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid vehicle id"})
+		return
+	}
+	limit, ok := etaLimit(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	bus, err := db.GetBus(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("get bus failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	now := time.Now()
+	v, err := h.estimator.Vehicle(ctx, bus, limit)
+	switch {
+	case errors.Is(err, eta.ErrNotLive):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, eta.ErrNoRoute), errors.Is(err, eta.ErrOffRoute):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		h.logger.Error("vehicle eta failed", zap.String("busId", id), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "eta failed"})
+		return
+	}
+	out := make([]VehicleStopETAResponse, len(v.Stops))
+	for i := range v.Stops {
+		s := &v.Stops[i]
+		out[i] = VehicleStopETAResponse{StopID: s.Stop.ID, Name: s.Stop.Name, Seq: s.Stop.Seq, ETAResponse: toETAResponse(s, now)}
+	}
+	c.JSON(http.StatusOK, gin.H{"busId": bus.ID, "routeId": bus.RouteID, "lastFixAt": v.FixAt.UTC(), "generatedAt": now.UTC(), "stops": out})
+}
+
+// etaLimit parses ?limit=, writing a 400 when it is invalid.
+func etaLimit(c *gin.Context) (int, bool) {
+	v := c.Query("limit")
+	if v == "" {
+		return defaultETALimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return 0, false
+	}
+	return min(n, maxETALimit), true
+}
@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/registry"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// FleetHandler serves the route, stop and bus registry.
+type FleetHandler struct {
+	logger *zap.Logger
+	// buses is dropped whenever a bus or route changes so ingest picks up
+	// the new assignment immediately on this instance.
+	buses *registry.BusCache
+}
+
+func NewFleetHandler(logger *zap.Logger, buses *registry.BusCache) *FleetHandler {
+	return &FleetHandler{logger: logger, buses: buses}
+}
+
+// --- Routes ---
+
+type RouteRequest struct {
+	Name     string                 `json:"name" binding:"required"`
+	Number   *string                `json:"number"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+type RouteResponse struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Number    *string                `json:"number"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+func toRouteResponse(r *db.Route) RouteResponse {
+	return RouteResponse{ID: r.ID, Name: r.Name, Number: r.Number, Metadata: r.Metadata, CreatedAt: r.CreatedAt}
+}
+
+func (req *RouteRequest) toRoute(id string) *db.Route {
+	return &db.Route{ID: id, Name: req.Name, Number: req.Number, Metadata: orEmpty(req.Metadata)}
+}
+
+// ListRoutes: GET /api/v1/routes?q=&number=&limit=&offset=
+func (h *FleetHandler) ListRoutes(c *gin.Context) {
+	opts, ok := listOptions(c)
+	if !ok {
+		return
+	}
+	routes, total, err := db.ListRoutes(c.Request.Context(), db.RouteFilter{Query: c.Query("q"), Number: c.Query("number")}, opts)
+	if err != nil {
+		h.dbError(c, "list routes", err)
+		return
+	}
+	out := make([]RouteResponse, len(routes))
+	for i := range routes {
+		out[i] = toRouteResponse(&routes[i])
+	}
+	c.JSON(http.StatusOK, page(out, total, opts))
+}
+
+// CreateRoute: POST /api/v1/routes
+func (h *FleetHandler) CreateRoute(c *gin.Context) {
+	var req RouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r, err := db.CreateRoute(c.Request.Context(), req.toRoute(""))
+	if err != nil {
+		h.dbError(c, "create route", err)
+		return
+	}
+	c.JSON(http.StatusCreated, toRouteResponse(r))
+}
+
+// GetRoute: GET /api/v1/routes/:id
+func (h *FleetHandler) GetRoute(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	r, err := db.GetRoute(c.Request.Context(), id)
+	if err != nil {
+		h.dbError(c, "get route", err)
+		return
+	}
+	c.JSON(http.StatusOK, toRouteResponse(r))
+}
+
+// UpdateRoute: PUT /api/v1/routes/:id
+func (h *FleetHandler) UpdateRoute(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	var req RouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r, err := db.UpdateRoute(c.Request.Context(), req.toRoute(id))
+	if err != nil {
+		h.dbError(c, "update route", err)
+		return
+	}
+	h.buses.Invalidate()
+	c.JSON(http.StatusOK, toRouteResponse(r))
+}
+
+// DeleteRoute: DELETE /api/v1/routes/:id
+func (h *FleetHandler) DeleteRoute(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteRoute(c.Request.Context(), id); err != nil {
+		h.dbError(c, "delete route", err)
+		return
+	}
+	h.buses.Invalidate()
+	c.Status(http.StatusNoContent)
+}
+
+// ListRouteStops: GET /api/v1/routes/:id/stops
+func (h *FleetHandler) ListRouteStops(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := db.GetRoute(ctx, id); err != nil {
+		h.dbError(c, "get route", err)
+		return
+	}
+	stops, err := db.ListRouteStops(ctx, id)
+	if err != nil {
+		h.dbError(c, "list route stops", err)
+		return
+	}
+	out := make([]StopResponse, len(stops))
+	for i := range stops {
+		out[i] = toStopResponse(&stops[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"routeId": id, "stops": out})
+}
+
+// ReorderRouteStops: PUT /api/v1/routes/:id/stops/order
+//
+// The body lists every stop of the route in travel order; seq is rewritten
+// to 1..n.
+func (h *FleetHandler) ReorderRouteStops(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		StopIDs []string `json:"stopIds" binding:"required,dive,uuid"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := db.GetRoute(ctx, id); err != nil {
+		h.dbError(c, "get route", err)
+		return
+	}
+	if err := db.ReorderRouteStops(ctx, id, req.StopIDs); err != nil {
+		h.dbError(c, "reorder route stops", err)
+		return
+	}
+	h.ListRouteStops(c)
+}
+
+// --- Stops ---
+
+type StopRequest struct {
+	RouteID   *string  `json:"routeId" binding:"omitempty,uuid"`
+	Name      string   `json:"name" binding:"required"`
+	Latitude  *float64 `json:"latitude" binding:"required,gte=-90,lte=90"`
+	Longitude *float64 `json:"longitude" binding:"required,gte=-180,lte=180"`
+	Seq       *int     `json:"seq" binding:"omitempty,gte=0"`
+}
+
+type StopResponse struct {
+	ID        string  `json:"id"`
+	RouteID   *string `json:"routeId"`
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Seq       *int    `json:"seq"`
+}
+
+func toStopResponse(s *db.Stop) StopResponse {
+	return StopResponse{ID: s.ID, RouteID: s.RouteID, Name: s.Name, Latitude: s.Latitude, Longitude: s.Longitude, Seq: s.Seq}
+}
+
+func (req *StopRequest) toStop(id string) *db.Stop {
+	return &db.Stop{ID: id, RouteID: req.RouteID, Name: req.Name, Latitude: *req.Latitude, Longitude: *req.Longitude, Seq: req.Seq}
+}
+
+// ListStops: GET /api/v1/stops?routeId=&q=&limit=&offset=
+func (h *FleetHandler) ListStops(c *gin.Context) {
+	opts, ok := listOptions(c)
+	if !ok {
+		return
+	}
+	stops, total, err := db.ListStops(c.Request.Context(), db.StopFilter{RouteID: c.Query("routeId"), Query: c.Query("q")}, opts)
+	if err != nil {
+		h.dbError(c, "list stops", err)
+		return
+	}
+	out := make([]StopResponse, len(stops))
+	for i := range stops {
+		out[i] = toStopResponse(&stops[i])
+	}
+	c.JSON(http.StatusOK, page(out, total, opts))
+}
+
+// CreateStop: POST /api/v1/stops
+func (h *FleetHandler) CreateStop(c *gin.Context) {
+	var req StopRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, err := db.CreateStop(c.Request.Context(), req.toStop(""))
+	if err != nil {
+		h.dbError(c, "create stop", err)
+		return
+	}
+	c.JSON(http.StatusCreated, toStopResponse(s))
+}
+
+// GetStop: GET /api/v1/stops/:id
+func (h *FleetHandler) GetStop(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	s, err := db.GetStop(c.Request.Context(), id)
+	if err != nil {
+		h.dbError(c, "get stop", err)
+		return
+	}
+	c.JSON(http.StatusOK, toStopResponse(s))
+}
+
+// UpdateStop: PUT /api/v1/stops/:id
+func (h *FleetHandler) UpdateStop(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	var req StopRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, err := db.UpdateStop(c.Request.Context(), req.toStop(id))
+	if err != nil {
+		h.dbError(c, "update stop", err)
+		return
+	}
+	c.JSON(http.StatusOK, toStopResponse(s))
+}
+
+// DeleteStop: DELETE /api/v1/stops/:id
+func (h *FleetHandler) DeleteStop(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteStop(c.Request.Context(), id); err != nil {
+		h.dbError(c, "delete stop", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// --- Buses ---
+
+type BusRequest struct {
+	RouteID        *string                `json:"routeId" binding:"omitempty,uuid"`
+	VehicleCode    *string                `json:"vehicleCode"`
+	RegistrationNo *string                `json:"registrationNo"`
+	Model          *string                `json:"model"`
+	Metadata       map[string]interface{} `json:"metadata"`
+}
+
+type BusResponse struct {
+	ID             string                 `json:"id"`
+	RouteID        *string                `json:"routeId"`
+	VehicleCode    *string                `json:"vehicleCode"`
+	RegistrationNo *string                `json:"registrationNo"`
+	Model          *string                `json:"model"`
+	Metadata       map[string]interface{} `json:"metadata"`
+	CreatedAt      time.Time              `json:"createdAt"`
+}
+
+func toBusResponse(b *db.Bus) BusResponse {
+	return BusResponse{
+		ID:             b.ID,
+		RouteID:        b.RouteID,
+		VehicleCode:    b.VehicleCode,
+		RegistrationNo: b.RegistrationNo,
+		Model:          b.Model,
+		Metadata:       b.Metadata,
+		CreatedAt:      b.CreatedAt,
+	}
+}
+
+func (req *BusRequest) toBus(id string) *db.Bus {
+	return &db.Bus{
+		ID:             id,
+		RouteID:        req.RouteID,
+		VehicleCode:    req.VehicleCode,
+		RegistrationNo: req.RegistrationNo,
+		Model:          req.Model,
+		Metadata:       orEmpty(req.Metadata),
+	}
+}
+
+// ListBuses: GET /api/v1/buses?routeId=&q=&limit=&offset=
+func (h *FleetHandler) ListBuses(c *gin.Context) {
+	opts, ok := listOptions(c)
+	if !ok {
+		return
+	}
+	buses, total, err := db.ListBuses(c.Request.Context(), db.BusFilter{RouteID: c.Query("routeId"), Query: c.Query("q")}, opts)
+	if err != nil {
+		h.dbError(c, "list buses", err)
+		return
+	}
+	out := make([]BusResponse, len(buses))
+	for i := range buses {
+		out[i] = toBusResponse(&buses[i])
+	}
+	c.JSON(http.StatusOK, page(out, total, opts))
+}
+
+// CreateBus: POST /api/v1/buses
+func (h *FleetHandler) CreateBus(c *gin.Context) {
+	var req BusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b, err := db.CreateBus(c.Request.Context(), req.toBus(""))
+	if err != nil {
+		h.dbError(c, "create bus", err)
+		return
+	}
+	h.buses.Invalidate()
+	c.JSON(http.StatusCreated, toBusResponse(b))
+}
+
+// GetBus: GET /api/v1/buses/:id
+func (h *FleetHandler) GetBus(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	b, err := db.GetBus(c.Request.Context(), id)
+	if err != nil {
+		h.dbError(c, "get bus", err)
+		return
+	}
+	c.JSON(http.StatusOK, toBusResponse(b))
+}
+
+// UpdateBus: PUT /api/v1/buses/:id
+func (h *FleetHandler) UpdateBus(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	var req BusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b, err := db.UpdateBus(c.Request.Context(), req.toBus(id))
+	if err != nil {
+		h.dbError(c, "update bus", err)
+		return
+	}
+	h.buses.Invalidate()
+	c.JSON(http.StatusOK, toBusResponse(b))
+}
+
+// DeleteBus: DELETE /api/v1/buses/:id
+func (h *FleetHandler) DeleteBus(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteBus(c.Request.Context(), id); err != nil {
+		h.dbError(c, "delete bus", err)
+		return
+	}
+	h.buses.Invalidate()
+	c.Status(http.StatusNoContent)
+}
+
+// --- helpers ---
+
+func (h *FleetHandler) dbError(c *gin.Context, op string, err error) {
+	writeDBError(c, h.logger, op, err)
+}
+
+// writeDBError maps repository errors to responses, logging unexpected ones.
+func writeDBError(c *gin.Context, logger *zap.Logger, op string, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	case errors.Is(err, db.ErrConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "already exists"})
+	case errors.Is(err, db.ErrInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": "still referenced"})
+	case errors.Is(err, db.ErrInvalidReference), errors.Is(err, db.ErrInvalidValue):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logger.Error(op+" failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+	}
+}
+
+// uuidParam reads a uuid path parameter, answering 400 when it is malformed.
+func uuidParam(c *gin.Context, name string) (string, bool) {
+	id := c.Param(name)
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+		return "", false
+	}
+	return id, true
+}
+
+// listOptions reads limit/offset query parameters, answering 400 when invalid.
+func listOptions(c *gin.Context) (db.ListOptions, bool) {
+	opts := db.ListOptions{Limit: defaultPageLimit}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return opts, false
+		}
+		opts.Limit = min(n, maxPageLimit)
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return opts, false
+		}
+		opts.Offset = n
+	}
+	return opts, true
+}
+
+func page(items interface{}, total int, opts db.ListOptions) gin.H {
+	return gin.H{"items": items, "total": total, "limit": opts.Limit, "offset": opts.Offset}
+}
+
+func orEmpty(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
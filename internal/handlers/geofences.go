@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/geofence"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	maxGeofenceRadius   = 50000.0
+	maxGeofenceVertices = 10000
+	defaultEventsLimit  = 100
+	maxEventsLimit      = 1000
+)
+
+// GeofenceHandler serves geofence CRUD and the events recorded for them.
+type GeofenceHandler struct {
+	logger *zap.Logger
+	// redis carries geofence.VersionKey, bumped on every change so workers
+	// reload their index.
+	redis *redisclient.Client
+}
+
+func NewGeofenceHandler(logger *zap.Logger, r *redisclient.Client) *GeofenceHandler {
+	return &GeofenceHandler{logger: logger, redis: r}
+}
+
+// GeoJSONPolygon is a GeoJSON Polygon geometry: rings of [lon, lat] pairs,
+// the exterior first, each closed.
+type GeoJSONPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+type GeofenceRequest struct {
+	Name string `json:"name" binding:"required"`
+	Kind string `json:"kind" binding:"required,oneof=polygon circle"`
+	// Geometry is required for polygons.
+	Geometry *GeoJSONPolygon `json:"geometry"`
+	// Latitude, Longitude and RadiusMeters are required for circles.
+	Latitude     *float64               `json:"latitude"`
+	Longitude    *float64               `json:"longitude"`
+	RadiusMeters *float64               `json:"radiusMeters"`
+	DwellSeconds *int                   `json:"dwellSeconds" binding:"omitempty,min=1"`
+	Active       *bool                  `json:"active"`
+	Metadata     map[string]interface{} `json:"metadata"`
+}
+
+type GeofenceResponse struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	Geometry     *GeoJSONPolygon        `json:"geometry"`
+	Latitude     *float64               `json:"latitude"`
+	Longitude    *float64               `json:"longitude"`
+	RadiusMeters *float64               `json:"radiusMeters"`
+	DwellSeconds *int                   `json:"dwellSeconds"`
+	Active       bool                   `json:"active"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	CreatedAt    time.Time              `json:"createdAt"`
+	UpdatedAt    time.Time              `json:"updatedAt"`
+}
+
+func toGeofenceResponse(g *db.Geofence) GeofenceResponse {
+	out := GeofenceResponse{
+		ID:           g.ID,
+		Name:         g.Name,
+		Kind:         g.Kind,
+		Latitude:     g.Latitude,
+		Longitude:    g.Longitude,
+		RadiusMeters: g.RadiusMeters,
+		DwellSeconds: g.DwellSeconds,
+		Active:       g.Active,
+		Metadata:     g.Metadata,
+		CreatedAt:    g.CreatedAt,
+		UpdatedAt:    g.UpdatedAt,
+	}
+	if g.Kind == db.GeofencePolygon {
+		out.Geometry = &GeoJSONPolygon{Type: "Polygon", Coordinates: g.Polygon}
+	}
+	return out
+}
+
+// validate checks the shape fields of the request's kind. Self-intersecting
+// polygons are rejected by the database.
+func (req *GeofenceRequest) validate() error {
+	if req.Kind == db.GeofenceCircle {
+		if req.Latitude == nil || req.Longitude == nil || req.RadiusMeters == nil {
+			return errors.New("circle requires latitude, longitude and radiusMeters")
+		}
+		if !validLatLon(*req.Latitude, *req.Longitude) {
+			return errors.New("invalid center")
+		}
+		if *req.RadiusMeters <= 0 || *req.RadiusMeters > maxGeofenceRadius {
+			return errors.New("radiusMeters must be in (0, 50000]")
+		}
+		return nil
+	}
+	if req.Geometry == nil || req.Geometry.Type != "Polygon" || len(req.Geometry.Coordinates) == 0 {
+		return errors.New("polygon requires a GeoJSON Polygon geometry")
+	}
+	vertices := 0
+	for _, ring := range req.Geometry.Coordinates {
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			return errors.New("polygon rings must be closed and have at least 4 positions")
+		}
+		for _, p := range ring {
+			if !validLatLon(p[1], p[0]) {
+				return errors.New("invalid polygon coordinates")
+			}
+		}
+		vertices += len(ring)
+	}
+	if vertices > maxGeofenceVertices {
+		return errors.New("polygon has too many positions")
+	}
+	return nil
+}
+
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+func (req *GeofenceRequest) toGeofence(id string) *db.Geofence {
+	g := &db.Geofence{ID: id, Name: req.Name, Kind: req.Kind, DwellSeconds: req.DwellSeconds, Active: true, Metadata: orEmpty(req.Metadata)}
+	if req.Active != nil {
+		g.Active = *req.Active
+	}
+	if req.Kind == db.GeofenceCircle {
+		g.Latitude, g.Longitude, g.RadiusMeters = req.Latitude, req.Longitude, req.RadiusMeters
+	} else {
+		g.Polygon = req.Geometry.Coordinates
+	}
+	return g
+}
+
+// bind reads and validates a create or update body, answering 400 when it is
+// invalid.
+func (h *GeofenceHandler) bind(c *gin.Context) (*GeofenceRequest, bool) {
+	var req GeofenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &req, true
+}
+
+// dbError answers like writeDBError, except that a check violation on a
+// validated request can only be an invalid polygon.
+func (h *GeofenceHandler) dbError(c *gin.Context, op string, err error) {
+	if errors.Is(err, db.ErrInvalidValue) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid geometry"})
+		return
+	}
+	writeDBError(c, h.logger, op, err)
+}
+
+// changed tells workers to reload geofences. Workers also reload on a timer,
+// so a failure only delays the change.
+func (h *GeofenceHandler) changed(c *gin.Context) {
+	if err := h.redis.RDB().Incr(c.Request.Context(), geofence.VersionKey).Err(); err != nil {
+		h.logger.Warn("bump geofence version failed", zap.Error(err))
+	}
+}
+
+// ListGeofences: GET /api/v1/geofences?q=&active=&limit=&offset=
+func (h *GeofenceHandler) ListGeofences(c *gin.Context) {
+	opts, ok := listOptions(c)
+	if !ok {
+		return
+	}
+	f := db.GeofenceFilter{Query: c.Query("q")}
+	if v := c.Query("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid active"})
+			return
+		}
+		f.Active = &active
+	}
+	fences, total, err := db.ListGeofences(c.Request.Context(), f, opts)
+	if err != nil {
+		h.dbError(c, "list geofences", err)
+		return
+	}
+	out := make([]GeofenceResponse, len(fences))
+	for i := range fences {
+		out[i] = toGeofenceResponse(&fences[i])
+	}
+	c.JSON(http.StatusOK, page(out, total, opts))
+}
+
+// CreateGeofence: POST /api/v1/geofences
+func (h *GeofenceHandler) CreateGeofence(c *gin.Context) {
+	req, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	g, err := db.CreateGeofence(c.Request.Context(), req.toGeofence(""))
+	if err != nil {
+		h.dbError(c, "create geofence", err)
+		return
+	}
+	h.changed(c)
+	c.JSON(http.StatusCreated, toGeofenceResponse(g))
+}
+
+// GetGeofence: GET /api/v1/geofences/:id
+func (h *GeofenceHandler) GetGeofence(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	g, err := db.GetGeofence(c.Request.Context(), id)
+	if err != nil {
+		h.dbError(c, "get geofence", err)
+		return
+	}
+	c.JSON(http.StatusOK, toGeofenceResponse(g))
+}
+
+// UpdateGeofence: PUT /api/v1/geofences/:id
+func (h *GeofenceHandler) UpdateGeofence(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	req, ok := h.bind(c)
+	if !ok {
+		return
+	}
+	g, err := db.UpdateGeofence(c.Request.Context(), req.toGeofence(id))
+	if err != nil {
+		h.dbError(c, "update geofence", err)
+		return
+	}
+	h.changed(c)
+	c.JSON(http.StatusOK, toGeofenceResponse(g))
+}
+
+// DeleteGeofence: DELETE /api/v1/geofences/:id
+func (h *GeofenceHandler) DeleteGeofence(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteGeofence(c.Request.Context(), id); err != nil {
+		h.dbError(c, "delete geofence", err)
+		return
+	}
+	h.changed(c)
+	c.Status(http.StatusNoContent)
+}
+
+type GeofenceEventResponse struct {
+	ID           int64   `json:"id"`
+	GeofenceID   string  `json:"geofenceId"`
+	BusID        string  `json:"busId"`
+	Event        string  `json:"event"`
+	Ts           int64   `json:"ts"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	DwellSeconds *int    `json:"dwellSeconds"`
+}
+
+// ListGeofenceEvents: GET /api/v1/geofences/:id/events?busId=&from=&to=&limit=
+//
+// from/to accept unix seconds or RFC3339 and default to the last 24 hours.
+// Events are returned newest first.
+func (h *GeofenceHandler) ListGeofenceEvents(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	busID := c.Query("busId")
+	if busID != "" {
+		if _, err := uuid.Parse(busID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid busId"})
+			return
+		}
+	}
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultHistoryWindow)
+	if v := c.Query("from"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	limit := defaultEventsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxEventsLimit)
+	}
+
+	ctx := c.Request.Context()
+	if _, err := db.GetGeofence(ctx, id); err != nil {
+		h.dbError(c, "get geofence", err)
+		return
+	}
+	events, err := db.ListGeofenceEvents(ctx, id, busID, from, to, limit)
+	if err != nil {
+		h.dbError(c, "list geofence events", err)
+		return
+	}
+	out := make([]GeofenceEventResponse, len(events))
+	for i, e := range events {
+		out[i] = GeofenceEventResponse{
+			ID:           e.ID,
+			GeofenceID:   e.GeofenceID,
+			BusID:        e.BusID,
+			Event:        e.Event,
+			Ts:           e.Ts.Unix(),
+			Lat:          e.Lat,
+			Lon:          e.Lon,
+			DwellSeconds: e.DwellSeconds,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"geofenceId": id, "events": out})
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/gtfs"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/registry"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxFeedBytes bounds an uploaded GTFS zip.
+const maxFeedBytes = 200 << 20
+
+// GTFSHandler imports GTFS static feeds.
+type GTFSHandler struct {
+	logger *zap.Logger
+	// buses is dropped after an import since routes may have been removed.
+	buses *registry.BusCache
+}
+
+func NewGTFSHandler(logger *zap.Logger, buses *registry.BusCache) *GTFSHandler {
+	return &GTFSHandler{logger: logger, buses: buses}
+}
+
+type GTFSImportResponse struct {
+	DryRun        bool `json:"dryRun"`
+	Agencies      int  `json:"agencies"`
+	Routes        int  `json:"routes"`
+	Stops         int  `json:"stops"`
+	Services      int  `json:"services"`
+	Shapes        int  `json:"shapes"`
+	Trips         int  `json:"trips"`
+	StopTimes     int  `json:"stopTimes"`
+	RemovedRoutes int  `json:"removedRoutes"`
+	RemovedStops  int  `json:"removedStops"`
+	RemovedTrips  int  `json:"removedTrips"`
+}
+
+// Import validates and imports a GTFS zip, sent either as the "feed" field of
+// a multipart form or as the raw request body. With ?dryRun=true the feed is
+// only validated. An invalid feed gets 422 with every problem by file and line.
+//
+//	POST /api/v1/admin/gtfs
+func (h *GTFSHandler) Import(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFeedBytes)
+	path, err := h.saveUpload(c.Request)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "feed too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload"})
+		return
+	}
+	defer os.Remove(path)
+
+	feed, err := gtfs.ParseFile(path)
+	var verrs gtfs.ValidationErrors
+	if errors.As(err, &verrs) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid feed", "errors": verrs})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not a GTFS zip"})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, GTFSImportResponse{
+			DryRun:    true,
+			Agencies:  len(feed.Agencies),
+			Routes:    len(feed.Routes),
+			Stops:     len(feed.Stops),
+			Services:  len(feed.Calendar),
+			Shapes:    len(feed.Shapes),
+			Trips:     len(feed.Trips),
+			StopTimes: len(feed.StopTimes),
+		})
+		return
+	}
+
+	st, err := db.ImportGTFS(c.Request.Context(), feed)
+	if err != nil {
+		h.logger.Error("gtfs import failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "import failed"})
+		return
+	}
+	h.buses.Invalidate()
+	h.logger.Info("gtfs feed imported",
+		zap.Int("routes", st.Routes), zap.Int("trips", st.Trips), zap.Int("stopTimes", st.StopTimes),
+		zap.Int("removedRoutes", st.RemovedRoutes), zap.Int("removedTrips", st.RemovedTrips))
+	c.JSON(http.StatusOK, GTFSImportResponse{
+		Agencies:      st.Agencies,
+		Routes:        st.Routes,
+		Stops:         st.Stops,
+		Services:      st.Services,
+		Shapes:        st.Shapes,
+		Trips:         st.Trips,
+		StopTimes:     st.StopTimes,
+		RemovedRoutes: st.RemovedRoutes,
+		RemovedStops:  st.RemovedStops,
+		RemovedTrips:  st.RemovedTrips,
+	})
+}
+
+// saveUpload writes the uploaded zip to a temp file, since reading a zip needs
+// random access. The caller removes the file.
+func (h *GTFSHandler) saveUpload(r *http.Request) (string, error) {
+	var src io.Reader = r.Body
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return "", err
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return "", err
+			}
+			if part.FormName() == "feed" {
+				src = part
+				break
+			}
+		}
+	}
+
+	f, err := os.CreateTemp("", "gtfs-*.zip")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/gtfsrt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// GTFSRTHandler serves the GTFS-Realtime feeds.
+type GTFSRTHandler struct {
+	logger *zap.Logger
+	feeds  *gtfsrt.Builder
+}
+
+func NewGTFSRTHandler(logger *zap.Logger, feeds *gtfsrt.Builder) *GTFSRTHandler {
+	return &GTFSRTHandler{logger: logger, feeds: feeds}
+}
+
+// VehiclePositions serves the live position of every vehicle.
+//
+//	GET /gtfs-rt/vehicle-positions?format=json
+func (h *GTFSRTHandler) VehiclePositions(c *gin.Context) {
+	h.serve(c, func(s *gtfsrt.Snapshot) *gtfsrt.Feed { return &s.VehiclePositions })
+}
+
+// TripUpdates serves predicted arrival and departure times of the trips
+// vehicles are running.
+//
+//	GET /gtfs-rt/trip-updates?format=json
+func (h *GTFSRTHandler) TripUpdates(c *gin.Context) {
+	h.serve(c, func(s *gtfsrt.Snapshot) *gtfsrt.Feed { return &s.TripUpdates })
+}
+
+// serve writes the protobuf feed, or JSON with ?format=json. Responses carry
+// Last-Modified and a max-age of the cache TTL, so pollers can use
+// conditional requests.
+func (h *GTFSRTHandler) serve(c *gin.Context, pick func(*gtfsrt.Snapshot) *gtfsrt.Feed) {
+	format := c.DefaultQuery("format", "protobuf")
+	if format != "protobuf" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be protobuf or json"})
+		return
+	}
+	snap, err := h.feeds.Snapshot(c.Request.Context())
+	if err != nil {
+		h.logger.Error("gtfs-rt build failed", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "feed unavailable"})
+		return
+	}
+	feed := pick(snap)
+
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(h.feeds.TTL().Seconds())))
+	if format == "json" {
+		c.Header("Last-Modified", snap.Built.UTC().Format(http.TimeFormat))
+		c.JSON(http.StatusOK, feed.Message)
+		return
+	}
+	c.Header("Content-Type", "application/x-protobuf")
+	http.ServeContent(c.Writer, c.Request, "", snap.Built, bytes.NewReader(feed.Proto))
+}
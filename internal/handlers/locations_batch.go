@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/registry"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	maxBatchItems = 500
+	maxBatchBytes = 2 << 20
+)
+
+// Per-item batch statuses. Devices should retry "failed" items only;
+// "rejected" items will never be accepted as sent.
+const (
+	BatchStatusAccepted = "accepted"
+	BatchStatusRejected = "rejected"
+	BatchStatusFailed   = "failed"
+)
+
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	MsgID  string `json:"msgId,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Failed   int               `json:"failed"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// PostBatch ingests many fixes at once, either as a JSON array or as NDJSON
+// (Content-Type: application/x-ndjson). Each item is validated, resolved
+// against the bus registry and checked against the authenticated device on its
+// own, all stream writes are pipelined, and only the newest fix per bus
+// updates live:vehicles, vehicle:<id>:last and the websocket channel.
+func (h *LocationsGinHandler) PostBatch(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes)
+	raws, err := decodeBatch(c.Request)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	if len(raws) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty batch"})
+		return
+	}
+	if len(raws) > maxBatchItems {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "too many items", "max": maxBatchItems})
+		return
+	}
+
+	deviceBusID := c.GetString("deviceBusId")
+	results := make([]BatchItemResult, len(raws))
+	reqs := make([]GLocationRequest, len(raws))
+	var valid []int
+	for i, raw := range raws {
+		results[i] = BatchItemResult{Index: i}
+		if err := json.Unmarshal(raw, &reqs[i]); err != nil {
+			results[i].Status = BatchStatusRejected
+			results[i].Error = "invalid body"
+			continue
+		}
+		if err := validateLocation(&reqs[i]); err != nil {
+			results[i].Status = BatchStatusRejected
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := h.resolveBus(c.Request.Context(), &reqs[i]); err != nil {
+			if errors.Is(err, registry.ErrUnknownBus) {
+				results[i].Status = BatchStatusRejected
+				results[i].Error = "unknown vehicle"
+			} else {
+				results[i].Status = BatchStatusFailed
+				results[i].Error = "vehicle registry unavailable"
+			}
+			continue
+		}
+		if reqs[i].BusID != deviceBusID {
+			results[i].Status = BatchStatusRejected
+			results[i].Error = "busId does not match device"
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	ctx := context.Background()
+	rdb := h.redis.RDB()
+
+	// Append every valid fix to the stream in a single round-trip.
+	values := make(map[int]map[string]interface{}, len(valid))
+	xadds := make(map[int]*redis.StringCmd, len(valid))
+	pipe := rdb.Pipeline()
+	for _, i := range valid {
+		values[i] = locationValues(uuid.New().String(), &reqs[i])
+		xadds[i] = pipe.XAdd(ctx, &redis.XAddArgs{Stream: "stream:positions", Values: values[i]})
+	}
+	_, _ = pipe.Exec(ctx)
+
+	newest := make(map[string]int)
+	for _, i := range valid {
+		if err := xadds[i].Err(); err != nil {
+			results[i].Status = BatchStatusFailed
+			results[i].Error = "ingest failed"
+			continue
+		}
+		results[i].Status = BatchStatusAccepted
+		results[i].MsgID = values[i]["msgId"].(string)
+		if j, ok := newest[reqs[i].BusID]; !ok || reqs[i].Timestamp > reqs[j].Timestamp {
+			newest[reqs[i].BusID] = i
+		}
+	}
+
+	if len(newest) > 0 {
+		h.updateLive(ctx, rdb, reqs, values, newest)
+	}
+
+	resp := BatchResponse{Results: results}
+	for _, r := range results {
+		switch r.Status {
+		case BatchStatusAccepted:
+			resp.Accepted++
+		case BatchStatusRejected:
+			resp.Rejected++
+		case BatchStatusFailed:
+			resp.Failed++
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// updateLive refreshes the live GEO set, last-known hash and websocket channel
+// for each bus with liveScript, which skips buses whose stored fix is already
+// newer than the batch (e.g. a live fix that arrived while the device was
+// replaying its buffer).
+func (h *LocationsGinHandler) updateLive(ctx context.Context, rdb *redis.Client, reqs []GLocationRequest, values map[int]map[string]interface{}, newest map[string]int) {
+	pipe := rdb.Pipeline()
+	for _, i := range newest {
+		b, _ := json.Marshal(values[i])
+		keys, args := liveArgs(&reqs[i], string(b))
+		// Eval rather than Run: EVALSHA cannot fall back to EVAL inside a pipeline
+		liveScript.Eval(ctx, pipe, keys, args...)
+	}
+	_, _ = pipe.Exec(ctx)
+}
+
+// decodeBatch splits the request body into raw per-item JSON documents so that
+// a malformed item only fails itself rather than the whole batch.
+func decodeBatch(r *http.Request) ([]json.RawMessage, error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt == "application/x-ndjson" || mt == "application/ndjson" {
+		var raws []json.RawMessage
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 0, 64*1024), maxBatchBytes)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			raws = append(raws, json.RawMessage(append([]byte(nil), line...)))
+		}
+		return raws, sc.Err()
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
@@ -2,14 +2,17 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
 	"encoding/json"
 
 	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/registry"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
 type GLocationRequest struct {
@@ -19,14 +22,18 @@ type GLocationRequest struct {
 	Timestamp int64   `json:"timestamp"`
 	SpeedKph  float64 `json:"speedKph"`
 	Heading   float64 `json:"heading"`
+
+	// routeID is filled in from the bus registry, never from the client.
+	routeID string
 }
 
 type LocationsGinHandler struct {
 	redis *redisclient.Client
+	buses *registry.BusCache
 }
 
-func NewLocationsGinHandler(r *redisclient.Client) *LocationsGinHandler {
-	return &LocationsGinHandler{redis: r}
+func NewLocationsGinHandler(r *redisclient.Client, buses *registry.BusCache) *LocationsGinHandler {
+	return &LocationsGinHandler{redis: r, buses: buses}
 }
 
 func (h *LocationsGinHandler) Post(c *gin.Context) {
@@ -35,37 +42,66 @@ func (h *LocationsGinHandler) Post(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 		return
 	}
-	if req.BusID == "" || req.Latitude < -90 || req.Latitude > 90 || req.Longitude < -180 || req.Longitude > 180 || req.Timestamp == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid fields"})
+	if err := validateLocation(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	t := time.Unix(req.Timestamp, 0)
-	if t.After(time.Now().Add(5 * time.Minute)) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "timestamp invalid"})
+	if err := h.resolveBus(c.Request.Context(), &req); err != nil {
+		if errors.Is(err, registry.ErrUnknownBus) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown vehicle"})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "vehicle registry unavailable"})
+		return
+	}
+	if req.BusID != c.GetString("deviceBusId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "busId does not match device"})
 		return
 	}
 
 	msgId := uuid.New().String()
-	values := map[string]interface{}{
-		"msgId":   msgId,
-		"busId":   req.BusID,
-		"lat":     req.Latitude,
-		"lon":     req.Longitude,
-		"ts":      req.Timestamp,
-		"speed":   req.SpeedKph,
-		"heading": req.Heading,
-	}
+	values := locationValues(msgId, &req)
 	ctx := context.Background()
 	if _, err := h.redis.XAdd(ctx, "stream:positions", values); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ingest failed"})
 		return
 	}
-	if err := h.redis.GeoAdd(ctx, "live:vehicles", req.Longitude, req.Latitude, req.BusID); err == nil {
-		_ = h.redis.HSet(ctx, "vehicle:"+req.BusID+":last", map[string]interface{}{
-			"lat": req.Latitude, "lon": req.Longitude, "ts": req.Timestamp, "speed": req.SpeedKph,
-		})
+	b, _ := json.Marshal(values)
+	keys, args := liveArgs(&req, string(b))
+	_ = liveScript.Run(ctx, h.redis.RDB(), keys, args...).Err()
+
+	c.Status(http.StatusNoContent)
+}
+
+// validateLocation applies the field checks shared by the single and batch ingest paths.
+func validateLocation(req *GLocationRequest) error {
+	if req.BusID == "" || req.Latitude < -90 || req.Latitude > 90 || req.Longitude < -180 || req.Longitude > 180 || req.Timestamp == 0 {
+		return errors.New("invalid fields")
+	}
+	t := time.Unix(req.Timestamp, 0)
+	if t.After(time.Now().Add(5 * time.Minute)) {
+		return errors.New("timestamp invalid")
+	}
+	return nil
+}
+
+// resolveBus rewrites req.BusID (a bus uuid or vehicle_code) to the registered
+// bus uuid and records the bus's current route.
+func (h *LocationsGinHandler) resolveBus(ctx context.Context, req *GLocationRequest) error {
+	bus, err := h.buses.Resolve(ctx, req.BusID)
+	if err != nil {
+		return err
+	}
+	req.BusID = bus.ID
+	if bus.RouteID != nil {
+		req.routeID = *bus.RouteID
 	}
-	event := map[string]interface{}{
+	return nil
+}
+
+// locationValues builds the stream entry (and websocket event) for a fix.
+func locationValues(msgId string, req *GLocationRequest) map[string]interface{} {
+	return map[string]interface{}{
 		"msgId":   msgId,
 		"busId":   req.BusID,
 		"lat":     req.Latitude,
@@ -73,10 +109,41 @@ func (h *LocationsGinHandler) Post(c *gin.Context) {
 		"ts":      req.Timestamp,
 		"speed":   req.SpeedKph,
 		"heading": req.Heading,
+		"routeId": req.routeID,
 	}
-	if b, err := json.Marshal(event); err == nil {
-		_ = h.redis.Publish(ctx, "vehicle:"+req.BusID, string(b))
+}
+
+// liveScript moves a bus in live:vehicles, replaces vehicle:<id>:last and
+// publishes the fix on vehicle:<id>, unless the stored fix is newer. The
+// check and the writes are one step, so a late fix cannot overwrite a newer
+// one stored by a concurrent request.
+//
+// KEYS live:vehicles, vehicle:<id>:last; ARGV ts, lon, lat, bus id, channel,
+// payload, then hash field/value pairs
+// returns 1 when stored, 0 when the stored fix is newer
+var liveScript = redis.NewScript(`
+local cur = tonumber(redis.call('HGET', KEYS[2], 'ts'))
+if cur and cur > tonumber(ARGV[1]) then return 0 end
+redis.call('GEOADD', KEYS[1], ARGV[2], ARGV[3], ARGV[4])
+redis.call('HSET', KEYS[2], unpack(ARGV, 7))
+redis.call('PUBLISH', ARGV[5], ARGV[6])
+return 1
+`)
+
+// liveArgs builds the liveScript keys and arguments for a fix and its
+// websocket payload.
+func liveArgs(req *GLocationRequest, payload string) ([]string, []interface{}) {
+	keys := []string{"live:vehicles", "vehicle:" + req.BusID + ":last"}
+	args := []interface{}{req.Timestamp, req.Longitude, req.Latitude, req.BusID, "vehicle:" + req.BusID, payload}
+	for k, v := range lastKnownValues(req) {
+		args = append(args, k, v)
 	}
+	return keys, args
+}
 
-	c.Status(http.StatusNoContent)
+// lastKnownValues builds the vehicle:<id>:last hash for a fix.
+func lastKnownValues(req *GLocationRequest) map[string]interface{} {
+	return map[string]interface{}{
+		"lat": req.Latitude, "lon": req.Longitude, "ts": req.Timestamp, "speed": req.SpeedKph, "heading": req.Heading, "routeId": req.routeID,
+	}
 }
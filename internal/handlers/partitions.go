@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type PartitionsHandler struct {
+	logger *zap.Logger
+}
+
+func NewPartitionsHandler(logger *zap.Logger) *PartitionsHandler {
+	return &PartitionsHandler{logger: logger}
+}
+
+type PartitionResponse struct {
+	Name         string    `json:"name"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	RowsEstimate int64     `json:"rowsEstimate"`
+	SizeBytes    int64     `json:"sizeBytes"`
+}
+
+// List reports the monthly partitions of the positions table.
+//
+//	GET /api/v1/admin/partitions
+func (h *PartitionsHandler) List(c *gin.Context) {
+	parts, err := db.ListPositionPartitions(c.Request.Context())
+	if err != nil {
+		h.logger.Error("list partitions failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]PartitionResponse, len(parts))
+	for i, p := range parts {
+		out[i] = PartitionResponse(p)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"partitions":  out,
+		"monthsAhead": db.PartitionsAhead(parts, time.Now()),
+	})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/auth"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// UsersHandler serves user administration.
+type UsersHandler struct {
+	logger   *zap.Logger
+	jwt      *auth.JWTManager
+	denylist *auth.Denylist
+}
+
+func NewUsersHandler(logger *zap.Logger, jwtMgr *auth.JWTManager, denylist *auth.Denylist) *UsersHandler {
+	return &UsersHandler{logger: logger, jwt: jwtMgr, denylist: denylist}
+}
+
+type UserResponse struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+func toUserResponse(u *db.User) UserResponse {
+	return UserResponse{ID: u.ID, Name: u.Name, Email: u.Email, Role: u.Role}
+}
+
+// SetRole changes a user's role. Access tokens already issued are revoked so
+// the new role applies from the user's next refresh.
+//
+//	PUT /api/v1/admin/users/:id/role
+func (h *UsersHandler) SetRole(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !auth.IsUserRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+		return
+	}
+	// An admin demoting themselves could leave nobody able to undo it.
+	if id == c.GetString("uid") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot change your own role"})
+		return
+	}
+	u, err := db.UpdateUserRole(c.Request.Context(), id, req.Role)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("update user role failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	h.logger.Info("user role changed", zap.String("user", u.ID), zap.String("role", u.Role), zap.String("by", c.GetString("uid")))
+	if err := h.denylist.RevokeAll(c.Request.Context(), u.ID, h.jwt.TTL()); err != nil {
+		h.logger.Error("revoke access tokens failed", zap.String("user", u.ID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "role changed but token revocation failed"})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(u))
+}
+
+// RevokeTokens signs a user out everywhere: all refresh tokens are revoked
+// and every access token issued so far is denylisted.
+//
+//	POST /api/v1/admin/users/:id/revoke-tokens
+func (h *UsersHandler) RevokeTokens(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := db.GetUserByID(ctx, id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		h.logger.Error("get user failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	if err := auth.RevokeUser(ctx, h.jwt, h.denylist, id, db.RevokedAdmin); err != nil {
+		h.logger.Error("revoke user tokens failed", zap.String("user", id), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	h.logger.Info("user tokens revoked", zap.String("user", id), zap.String("by", c.GetString("uid")))
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHistoryLimit  = 500
+	maxHistoryLimit      = 5000
+	defaultHistoryWindow = 24 * time.Hour
+
+	defaultNearbyRadius = 1000.0
+	defaultNearbyLimit  = 50
+	maxNearbyLimit      = 500
+	maxNearbyRadiusM    = 50000.0
+)
+
+// unitMeters converts the GEOSEARCH units we accept into meters for bounds checks.
+var unitMeters = map[string]float64{"m": 1, "km": 1000, "mi": 1609.344, "ft": 0.3048}
+
+type VehiclesHandler struct {
+	logger     *zap.Logger
+	redis      *redisclient.Client
+	staleAfter time.Duration
+}
+
+func NewVehiclesHandler(logger *zap.Logger, r *redisclient.Client, staleAfter time.Duration) *VehiclesHandler {
+	return &VehiclesHandler{logger: logger, redis: r, staleAfter: staleAfter}
+}
+
+type PositionResponse struct {
+	Ts       int64    `json:"ts"`
+	Lat      float64  `json:"lat"`
+	Lon      float64  `json:"lon"`
+	SpeedKph *float64 `json:"speedKph,omitempty"`
+	Heading  *float64 `json:"heading,omitempty"`
+	RouteID  *string  `json:"routeId,omitempty"`
+}
+
+// Positions returns the stored fixes of a vehicle ordered by time.
+//
+//	GET /api/v1/vehicles/:id/positions?from=&to=&limit=&cursor=&format=geojson
+//
+// from/to accept unix seconds or RFC3339 and default to the last 24 hours.
+// Pass nextCursor from a previous page as cursor to continue.
+func (h *VehiclesHandler) Positions(c *gin.Context) {
+	busID := c.Param("id")
+	if _, err := uuid.Parse(busID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid vehicle id"})
+		return
+	}
+
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultHistoryWindow)
+	if v := c.Query("from"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+
+	var cursor *db.PositionCursor
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodePositionCursor(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		cursor = cur
+	}
+
+	// Fetch one extra row to know whether another page exists.
+	rows, err := db.ListPositions(c.Request.Context(), busID, from, to, cursor, limit+1)
+	if err != nil {
+		h.logger.Error("list positions failed", zap.String("busId", busID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	var nextCursor string
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		nextCursor = encodePositionCursor(&db.PositionCursor{Ts: last.Ts, ID: last.ID})
+	}
+
+	if c.Query("format") == "geojson" {
+		coords := make([][2]float64, len(rows))
+		times := make([]int64, len(rows))
+		for i, p := range rows {
+			coords[i] = [2]float64{p.Lon, p.Lat}
+			times[i] = p.Ts.Unix()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"type": "Feature",
+			"geometry": gin.H{
+				"type":        "LineString",
+				"coordinates": coords,
+			},
+			"properties": gin.H{
+				"busId":      busID,
+				"timestamps": times,
+				"nextCursor": nextCursor,
+			},
+		})
+		return
+	}
+
+	out := make([]PositionResponse, len(rows))
+	for i, p := range rows {
+		out[i] = PositionResponse{
+			Ts:       p.Ts.Unix(),
+			Lat:      p.Lat,
+			Lon:      p.Lon,
+			SpeedKph: p.SpeedKph,
+			Heading:  p.Heading,
+			RouteID:  p.RouteID,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"busId":      busID,
+		"positions":  out,
+		"nextCursor": nextCursor,
+	})
+}
+
+type NearbyVehicle struct {
+	BusID    string  `json:"busId"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Distance float64 `json:"distance"`
+	SpeedKph float64 `json:"speedKph"`
+	Ts       int64   `json:"ts"`
+}
+
+// Nearby lists live vehicles around a point, closest first.
+//
+//	GET /api/v1/vehicles/nearby?lat=&lon=&radius=&unit=&limit=
+//
+// Vehicles whose last fix is older than the configured staleness window are
+// left out even though they are still members of live:vehicles; the search
+// widens until limit fresh vehicles are found or the radius is exhausted.
+func (h *VehiclesHandler) Nearby(c *gin.Context) {
+	lat, errLat := strconv.ParseFloat(c.Query("lat"), 64)
+	lon, errLon := strconv.ParseFloat(c.Query("lon"), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lat/lon"})
+		return
+	}
+	unit := c.DefaultQuery("unit", "m")
+	perMeter, ok := unitMeters[unit]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unit must be one of m, km, mi, ft"})
+		return
+	}
+	radius := defaultNearbyRadius / perMeter
+	if v := c.Query("radius"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r <= 0 || r*perMeter > maxNearbyRadiusM {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid radius"})
+			return
+		}
+		radius = r
+	}
+	limit := defaultNearbyLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxNearbyLimit)
+	}
+
+	ctx := c.Request.Context()
+	rdb := h.redis.RDB()
+	cutoff := time.Now().Add(-h.staleAfter).Unix()
+	out := make([]NearbyVehicle, 0, limit)
+	checked := make(map[string]bool)
+	// Over-fetch so that dropping stale members still leaves enough results,
+	// and search again with a larger count while stale members crowd them out.
+	for count := limit * 4; ; count *= 2 {
+		hits, err := rdb.GeoSearchLocation(ctx, "live:vehicles", &redis.GeoSearchLocationQuery{
+			GeoSearchQuery: redis.GeoSearchQuery{
+				Longitude:  lon,
+				Latitude:   lat,
+				Radius:     radius,
+				RadiusUnit: unit,
+				Sort:       "ASC",
+				Count:      count,
+			},
+			WithCoord: true,
+			WithDist:  true,
+		}).Result()
+		if err != nil {
+			h.logger.Error("geosearch failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+			return
+		}
+
+		// members checked by an earlier search are skipped
+		var fresh []redis.GeoLocation
+		for _, hit := range hits {
+			if !checked[hit.Name] {
+				checked[hit.Name] = true
+				fresh = append(fresh, hit)
+			}
+		}
+		lasts := make([]*redis.MapStringStringCmd, len(fresh))
+		if len(fresh) > 0 {
+			pipe := rdb.Pipeline()
+			for i, hit := range fresh {
+				lasts[i] = pipe.HGetAll(ctx, "vehicle:"+hit.Name+":last")
+			}
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				h.logger.Error("last-known lookup failed", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+				return
+			}
+		}
+
+		for i, hit := range fresh {
+			last := lasts[i].Val()
+			ts, err := strconv.ParseInt(last["ts"], 10, 64)
+			if err != nil || ts < cutoff {
+				continue
+			}
+			speed, _ := strconv.ParseFloat(last["speed"], 64)
+			out = append(out, NearbyVehicle{
+				BusID:    hit.Name,
+				Lat:      hit.Latitude,
+				Lon:      hit.Longitude,
+				Distance: hit.Dist,
+				SpeedKph: speed,
+				Ts:       ts,
+			})
+			if len(out) == limit {
+				break
+			}
+		}
+		// fewer hits than asked for means the whole radius was searched
+		if len(out) == limit || len(hits) < count {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unit": unit, "vehicles": out})
+}
+
+// parseTimeParam accepts unix seconds or an RFC3339 timestamp.
+func parseTimeParam(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// Cursors are opaque to clients: base64("<unix-nanos>:<id>").
+func encodePositionCursor(cur *db.PositionCursor) string {
+	raw := fmt.Sprintf("%d:%d", cur.Ts.UnixNano(), cur.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodePositionCursor(v string) (*db.PositionCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	tsPart, idPart, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return nil, errors.New("malformed cursor")
+	}
+	ns, err := strconv.ParseInt(tsPart, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &db.PositionCursor{Ts: time.Unix(0, ns), ID: id}, nil
+}
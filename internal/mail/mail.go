@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers account emails. Production deployments plug in an SMTP or
+// provider-backed implementation; LogMailer and FileMailer are for local
+// development.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer logs each message instead of sending it. Bodies carry live
+// verification and reset tokens, so they are only logged at debug level;
+// at info only the recipient and subject are.
+type LogMailer struct {
+	logger *zap.Logger
+	from   string
+}
+
+func NewLogMailer(logger *zap.Logger, from string) *LogMailer {
+	return &LogMailer{logger: logger, from: from}
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	m.logger.Info("mail",
+		zap.String("from", m.from),
+		zap.String("to", msg.To),
+		zap.String("subject", msg.Subject))
+	m.logger.Debug("mail body", zap.String("to", msg.To), zap.String("body", msg.Body))
+	return nil
+}
+
+// FileMailer writes each message as an .eml file into dir, where it can be
+// opened with any mail client.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	now := time.Now().UTC()
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000"), uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(b.String()), 0o644)
+}
+
+// New builds the mailer selected by driver: "log" (default) or "file".
+func New(driver, dir, from string, logger *zap.Logger) (Mailer, error) {
+	switch driver {
+	case "", "log":
+		return NewLogMailer(logger, from), nil
+	case "file":
+		return NewFileMailer(dir, from)
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
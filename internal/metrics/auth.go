@@ -0,0 +1,17 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// LoginFailed counts logins rejected for a wrong email or password.
+	LoginFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_login_failed_total",
+		Help: "Login attempts rejected for invalid credentials.",
+	})
+	// LoginLocked counts logins refused without checking the password because
+	// the account or client IP is backing off or locked out.
+	LoginLocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_login_locked_total",
+		Help: "Login attempts refused while the account or IP was backing off or locked.",
+	}, []string{"scope"})
+)
@@ -8,28 +8,87 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware validates JWT access token and attaches uid & role to Gin context
-func AuthMiddleware(jwtMgr *auth.JWTManager) gin.HandlerFunc {
+// AuthMiddleware validates JWT access token and attaches uid & role to Gin context.
+// Tokens on the denylist are rejected.
+func AuthMiddleware(jwtMgr *auth.JWTManager, denylist *auth.Denylist) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		h := c.GetHeader("Authorization")
-		if h == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing authorization header"})
+		claims, ok := bearerClaims(c, jwtMgr, denylist)
+		if !ok {
 			return
 		}
-		parts := strings.SplitN(h, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header"})
-			return
-		}
-		token := parts[1]
-		claims, err := jwtMgr.ValidateToken(token)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		if claims.Role == auth.RoleDevice {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "device tokens are only valid for ingest"})
 			return
 		}
 		// attach to context
 		c.Set("uid", claims.UserID)
 		c.Set("role", claims.Role)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// DeviceAuthMiddleware only admits device tokens and attaches the bus the
+// device is bound to as "deviceBusId". Handlers must still check that posted
+// fixes are for that bus.
+func DeviceAuthMiddleware(jwtMgr *auth.JWTManager, denylist *auth.Denylist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := bearerClaims(c, jwtMgr, denylist)
+		if !ok {
+			return
+		}
+		if !auth.HasPermission(claims.Role, auth.PermPositionsWrite) || claims.BusID == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "device token required"})
+			return
+		}
+		c.Set("role", claims.Role)
+		c.Set("deviceBusId", claims.BusID)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// bearerClaims validates the bearer token of the request, aborting with 401
+// when it is missing, invalid or revoked. Revocation is checked fail-closed.
+func bearerClaims(c *gin.Context, jwtMgr *auth.JWTManager, denylist *auth.Denylist) (*auth.Claims, bool) {
+	h := c.GetHeader("Authorization")
+	if h == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing authorization header"})
+		return nil, false
+	}
+	parts := strings.SplitN(h, " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header"})
+		return nil, false
+	}
+	claims, err := jwtMgr.ValidateToken(parts[1])
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return nil, false
+	}
+	revoked, err := denylist.IsRevoked(c.Request.Context(), claims)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "token check unavailable"})
+		return nil, false
+	}
+	if revoked {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// RequirePermission rejects requests whose authenticated role lacks any of
+// perms. It must run after AuthMiddleware.
+func RequirePermission(perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, p := range perms {
+			if !auth.HasPermission(role, p) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+				return
+			}
+		}
 		c.Next()
 	}
 }
@@ -2,53 +2,214 @@ package middleware
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
-// RateLimiterMiddleware creates a simple fixed-window rate limiter using Redis.
-// It increments a per-client key and rejects requests exceeding the provided limit
-// within the given window duration.
-func RateLimiterMiddleware(rdb *redis.Client, limit int, window time.Duration) gin.HandlerFunc {
+// RateLimitResult is the outcome of one Allow call.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the limiter is back to its full allowance.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client must wait for the next
+	// request to be allowed. Zero when Allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether one more request from a client is allowed. Both
+// implementations run as a single Lua script, so check-and-update is atomic
+// and every key carries an expiry.
+type Limiter interface {
+	Allow(ctx context.Context, clientID string) (RateLimitResult, error)
+}
+
+// slidingWindowScript keeps a sorted set of request timestamps (ms) per
+// client and admits a request while fewer than limit fall inside the window.
+// Time comes from the Redis server so all API instances share one clock.
+//
+// KEYS[1] set key; ARGV window ms, limit, unique member
+// returns {allowed, remaining, reset ms, retry ms}
+var slidingWindowScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', KEYS[1], now, now .. '-' .. ARGV[3])
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local reset = 0
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+if newest[2] then reset = tonumber(newest[2]) + window - now end
+local retry = 0
+if allowed == 0 then
+  -- the request that has to age out before one more fits
+  local idx = count - limit
+  local e = redis.call('ZRANGE', KEYS[1], idx, idx, 'WITHSCORES')
+  retry = tonumber(e[2]) + window - now
+end
+local remaining = limit - count
+if remaining < 0 then remaining = 0 end
+return {allowed, remaining, reset, retry}
+`)
+
+// SlidingWindowLimiter allows limit requests in any window-long interval.
+// Unlike fixed windows it has no 2x burst at window edges.
+type SlidingWindowLimiter struct {
+	rdb    *redis.Client
+	name   string
+	limit  int
+	window time.Duration
+}
+
+// NewSlidingWindowLimiter creates a sliding-window log limiter. name keeps
+// the counters of different route groups apart.
+func NewSlidingWindowLimiter(rdb *redis.Client, name string, limit int, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{rdb: rdb, name: name, limit: limit, window: window}
+}
+
+func (l *SlidingWindowLimiter) Allow(ctx context.Context, clientID string) (RateLimitResult, error) {
+	key := "ratelimit:sw:" + l.name + ":" + clientID
+	res, err := slidingWindowScript.Run(ctx, l.rdb, []string{key}, l.window.Milliseconds(), l.limit, nonce()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Limit:      l.limit,
+		Remaining:  int(res[1]),
+		Reset:      time.Duration(res[2]) * time.Millisecond,
+		RetryAfter: time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
+
+// tokenBucketScript refills a bucket of burst tokens at rate tokens/ms and
+// takes one token per request.
+//
+// KEYS[1] hash key; ARGV burst, rate per ms
+// returns {allowed, remaining, reset ms, retry ms}
+var tokenBucketScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+  tokens = burst
+  ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate)
+end
+local reset = math.ceil((burst - tokens) / rate)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+-- a bucket that has refilled completely is the same as no bucket
+redis.call('PEXPIRE', KEYS[1], math.max(reset, 1))
+return {allowed, math.floor(tokens), reset, retry}
+`)
+
+// TokenBucketLimiter allows bursts of up to burst requests and a sustained
+// rate of limit requests per period.
+type TokenBucketLimiter struct {
+	rdb    *redis.Client
+	name   string
+	limit  int
+	period time.Duration
+	burst  int
+}
+
+// NewTokenBucketLimiter creates a token-bucket limiter. name keeps the
+// buckets of different route groups apart.
+func NewTokenBucketLimiter(rdb *redis.Client, name string, limit int, period time.Duration, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{rdb: rdb, name: name, limit: limit, period: period, burst: burst}
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, clientID string) (RateLimitResult, error) {
+	key := "ratelimit:tb:" + l.name + ":" + clientID
+	rate := float64(l.limit) / float64(l.period.Milliseconds())
+	res, err := tokenBucketScript.Run(ctx, l.rdb, []string{key}, l.burst, strconv.FormatFloat(rate, 'g', -1, 64)).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Limit:      l.burst,
+		Remaining:  int(res[1]),
+		Reset:      time.Duration(res[2]) * time.Millisecond,
+		RetryAfter: time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
+
+func nonce() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ceilSeconds rounds up so clients never retry early.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// RateLimit applies l to every request, keyed by the authenticated device or
+// user when an auth middleware ran first, otherwise by IP; client-supplied
+// headers are never trusted.
+func RateLimit(l Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx := context.Background()
-
-		clientID := c.ClientIP()
-		if busID := c.GetHeader("X-Bus-ID"); busID != "" {
-			clientID = busID
-		}
-		if clientID == "" {
-			clientID = "unknown"
-		}
-
-		// Use a windowed key bucket per client
-		bucket := time.Now().Unix() / int64(window.Seconds())
-		key := fmt.Sprintf("ratelimit:%s:%d", clientID, bucket)
-
-		// Increment request count atomically
-		count, err := rdb.Incr(ctx, key).Result()
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "rate limiter unavailable"})
-			return
-		}
-		if count == 1 {
-			_ = rdb.Expire(ctx, key, window).Err()
-		}
-
-		if count > int64(limit) {
-			c.Header("Retry-After", fmt.Sprintf("%d", int(window.Seconds())))
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-				"error":  "rate limit exceeded",
-				"limit":  limit,
-				"window": window.Seconds(),
-			})
-			return
-		}
-
-		c.Next()
+		_, id := principal(c)
+		enforce(c, l, id)
+	}
+}
+
+// enforce takes one request from clientID's allowance and reports it in
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (seconds
+// until the allowance is full again). Rejected requests get 429 with
+// Retry-After.
+func enforce(c *gin.Context, l Limiter, clientID string) {
+	res, err := l.Allow(c.Request.Context(), clientID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "rate limiter unavailable"})
+		return
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("X-RateLimit-Reset", ceilSeconds(res.Reset))
+	if !res.Allowed {
+		c.Header("Retry-After", ceilSeconds(res.RetryAfter))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error":      "rate limit exceeded",
+			"limit":      res.Limit,
+			"retryAfter": math.Ceil(res.RetryAfter.Seconds()),
+		})
+		return
 	}
+
+	c.Next()
 }
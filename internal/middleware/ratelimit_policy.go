@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Principal types a rate-limit policy can apply to.
+const (
+	PrincipalUser      = "user"
+	PrincipalDevice    = "device"
+	PrincipalAnonymous = "anonymous"
+	PrincipalAny       = "any"
+)
+
+// Rate-limit algorithms.
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+)
+
+// RateLimitPolicy limits one kind of principal on the routes matching Route.
+// Route is a gin route pattern as registered (e.g. "/auth/register" or
+// "/api/v1/vehicles/:id/positions"); a trailing "*" matches every route
+// with that prefix. Window is the sliding window, or for a token bucket the
+// period over which Limit tokens are refilled; Burst is the bucket size.
+type RateLimitPolicy struct {
+	Name      string
+	Route     string
+	Principal string
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+	Burst     int
+}
+
+type boundPolicy struct {
+	RateLimitPolicy
+	limiter Limiter
+}
+
+func (p *boundPolicy) matches(route, principal string) bool {
+	if p.Principal != PrincipalAny && p.Principal != principal {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(p.Route, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return route == p.Route
+}
+
+// principal identifies who is making the request, from what the auth
+// middleware established: the device's bus, the user, or else the client IP.
+func principal(c *gin.Context) (kind, id string) {
+	if busID := c.GetString("deviceBusId"); busID != "" {
+		return PrincipalDevice, "bus:" + busID
+	}
+	if uid := c.GetString("uid"); uid != "" {
+		return PrincipalUser, "user:" + uid
+	}
+	ip := c.ClientIP()
+	if ip == "" {
+		ip = "unknown"
+	}
+	return PrincipalAnonymous, "ip:" + ip
+}
+
+// RateLimitPolicies applies the first policy matching the request's route and
+// principal, counting per principal and policy. Requests no policy matches
+// are not limited. Mount it after the auth middleware of a group so users
+// and devices are keyed by identity rather than IP.
+func RateLimitPolicies(rdb *redis.Client, policies []RateLimitPolicy) (gin.HandlerFunc, error) {
+	bound := make([]*boundPolicy, 0, len(policies))
+	for i, p := range policies {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("policy%d", i)
+		}
+		if p.Principal == "" {
+			p.Principal = PrincipalAny
+		}
+		switch p.Principal {
+		case PrincipalUser, PrincipalDevice, PrincipalAnonymous, PrincipalAny:
+		default:
+			return nil, fmt.Errorf("rate limit policy %s: unknown principal %q", p.Name, p.Principal)
+		}
+		if p.Limit <= 0 || p.Window <= 0 {
+			return nil, fmt.Errorf("rate limit policy %s: limit and window must be positive", p.Name)
+		}
+		var l Limiter
+		switch p.Algorithm {
+		case "", AlgorithmSlidingWindow:
+			l = NewSlidingWindowLimiter(rdb, p.Name, p.Limit, p.Window)
+		case AlgorithmTokenBucket:
+			if p.Burst <= 0 {
+				p.Burst = p.Limit
+			}
+			l = NewTokenBucketLimiter(rdb, p.Name, p.Limit, p.Window, p.Burst)
+		default:
+			return nil, fmt.Errorf("rate limit policy %s: unknown algorithm %q", p.Name, p.Algorithm)
+		}
+		bound = append(bound, &boundPolicy{RateLimitPolicy: p, limiter: l})
+	}
+
+	return func(c *gin.Context) {
+		kind, id := principal(c)
+		route := c.FullPath()
+		for _, p := range bound {
+			if p.matches(route, kind) {
+				c.Header("X-RateLimit-Policy", p.Name)
+				enforce(c, p.limiter, id)
+				return
+			}
+		}
+		c.Next()
+	}, nil
+}
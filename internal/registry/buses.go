@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/google/uuid"
+)
+
+// ErrUnknownBus is returned when an identifier matches no registered bus.
+var ErrUnknownBus = errors.New("unknown vehicle")
+
+// maxEntries bounds the cache so a device spamming made-up IDs cannot grow it
+// without limit; the whole cache is dropped when it is reached.
+const maxEntries = 50000
+
+// BusCache resolves the identifiers devices post (bus uuid or vehicle_code)
+// to registered buses. Hits are cached for ttl and misses for negativeTTL, so
+// registry edits become visible to ingest within those windows.
+type BusCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]busEntry
+}
+
+type busEntry struct {
+	bus     *db.Bus // nil for a cached miss
+	expires time.Time
+}
+
+func NewBusCache(ttl, negativeTTL time.Duration) *BusCache {
+	return &BusCache{ttl: ttl, negativeTTL: negativeTTL, entries: make(map[string]busEntry)}
+}
+
+// Resolve returns the bus identified by ident, or ErrUnknownBus.
+func (c *BusCache) Resolve(ctx context.Context, ident string) (*db.Bus, error) {
+	now := time.Now()
+	c.mu.RLock()
+	e, ok := c.entries[ident]
+	c.mu.RUnlock()
+	if ok && now.Before(e.expires) {
+		if e.bus == nil {
+			return nil, ErrUnknownBus
+		}
+		return e.bus, nil
+	}
+
+	var bus *db.Bus
+	var err error
+	if _, perr := uuid.Parse(ident); perr == nil {
+		bus, err = db.GetBus(ctx, ident)
+	} else {
+		bus, err = db.GetBusByVehicleCode(ctx, ident)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		c.store(ident, busEntry{expires: now.Add(c.negativeTTL)})
+		return nil, ErrUnknownBus
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := busEntry{bus: bus, expires: now.Add(c.ttl)}
+	c.store(ident, entry)
+	c.store(bus.ID, entry)
+	return bus, nil
+}
+
+// Invalidate drops every cached entry, e.g. after a bus was edited.
+func (c *BusCache) Invalidate() {
+	c.mu.Lock()
+	c.entries = make(map[string]busEntry)
+	c.mu.Unlock()
+}
+
+func (c *BusCache) store(key string, e busEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxEntries {
+		c.entries = make(map[string]busEntry)
+	}
+	c.entries[key] = e
+}
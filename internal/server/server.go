@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,14 +14,20 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/auth"
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/config"
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/db"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/eta"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/gtfsrt"
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/handlers"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/mail"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/metrics"
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/middleware"
 	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/registry"
 	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/ws"
 )
 
@@ -57,6 +64,11 @@ func New(cfg *config.Config) *Server {
 	}
 
 	router := gin.New()
+	// Client IPs key login throttling and anonymous rate limits, so
+	// X-Forwarded-For is only believed from configured proxies.
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logger.Fatal("invalid trusted proxies", zap.Error(err))
+	}
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
@@ -118,12 +130,46 @@ func (s *Server) setupRoutes() {
 	r := redisclient.New(redisAddr)
 	s.redis = r
 
+	// Initialize JWT manager when both key paths are set
+	jwtMgr, jwtErr := newJWTManager()
+	if jwtErr != nil {
+		s.logger.Warn("failed to initialize JWT manager", zap.Error(jwtErr))
+	} else {
+		// Pick up rotated key files without a restart
+		reload := time.Minute
+		if d, err := time.ParseDuration(os.Getenv("JWT_KEYS_RELOAD_INTERVAL")); err == nil && d > 0 {
+			reload = d
+		}
+		go jwtMgr.WatchKeys(context.Background(), reload, s.logger)
+	}
+
+	// Access-token denylist shared by the auth middleware and the broker
+	denylist := auth.NewDenylist(r.RDB())
+
+	// Failed-login backoff and lockout
+	login := s.config.Login
+	policy := func(maxAttempts int) auth.ThrottlePolicy {
+		return auth.ThrottlePolicy{FreeAttempts: maxAttempts / 3, LockAfter: maxAttempts, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: login.Lockout}
+	}
+	throttle := auth.NewLoginThrottle(r.RDB(), policy(login.MaxAttempts), policy(login.IPMaxAttempts))
+
+	// Account emails (verification, password reset)
+	mailer, err := mail.New(s.config.Mail.Driver, s.config.Mail.Dir, s.config.Mail.From, s.logger)
+	if err != nil {
+		s.logger.Warn("mailer setup failed, logging mail instead", zap.Error(err))
+		mailer = mail.NewLogMailer(s.logger, s.config.Mail.From)
+	}
+	emails := auth.NewAccountEmails(mailer, s.config.Mail.LinkBaseURL, s.logger)
+
 	// WebSocket broker
-	broker := ws.NewBroker(r)
+	broker := ws.NewBroker(r, jwtMgr, denylist, s.config.WebSocket.AllowedOrigins)
 	s.broker = broker
 
 	// Locations handler uses the redis client
-	locations := handlers.NewLocationsGinHandler(r)
+	buses := registry.NewBusCache(time.Minute, 10*time.Second)
+	locations := handlers.NewLocationsGinHandler(r, buses)
+	vehicles := handlers.NewVehiclesHandler(s.logger, r, s.config.Vehicles.StaleAfter)
+	etas := handlers.NewETAHandler(s.logger, eta.NewEstimator(r, s.config.Vehicles.StaleAfter, s.config.ETA.HistoryWindow, s.config.ETA.CacheTTL))
 
 	// --- Health Check Routes ---
 	s.router.GET("/health/live", func(c *gin.Context) {
@@ -152,57 +198,229 @@ func (s *Server) setupRoutes() {
 	})
 
 	// Prometheus metrics endpoint
+	prometheus.MustRegister(metrics.NewPartitionCollector(), metrics.LoginFailed, metrics.LoginLocked)
 	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	var unavailable gin.HandlerFunc
+	if jwtErr != nil {
+		unavailable = func(c *gin.Context) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": jwtErr.Error()})
+		}
+	}
+
+	userAuth, deviceAuth := unavailable, unavailable
+	if jwtMgr != nil {
+		userAuth = middleware.AuthMiddleware(jwtMgr, denylist)
+		deviceAuth = middleware.DeviceAuthMiddleware(jwtMgr, denylist)
+	}
+
+	// Public keys for services that verify our tokens themselves
+	s.router.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		if jwtMgr == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": jwtErr.Error()})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, jwtMgr.JWKS())
+	})
+
+	// Rate limits by route and principal, from config. The limiter runs after
+	// each group's auth middleware so users and devices count by identity;
+	// preAuth runs before it on user routes and counts by IP, so requests with
+	// bad tokens cannot flood the token checks. Ingest skips it: buses behind
+	// one carrier NAT or depot uplink share an IP.
+	limiter, err := middleware.RateLimitPolicies(r.RDB(), rateLimitPolicies(s.config.RateLimit.Policies))
+	if err != nil {
+		s.logger.Fatal("invalid rate limit policies", zap.Error(err))
+	}
+	preAuth, err := middleware.RateLimitPolicies(r.RDB(), rateLimitPolicies(s.config.RateLimit.PreAuth))
+	if err != nil {
+		s.logger.Fatal("invalid pre-auth rate limit policies", zap.Error(err))
+	}
+
 	// --- Auth Routes ---
-	authGroup := s.router.Group("/auth")
+	authGroup := s.router.Group("/auth", limiter)
 	{
-		authGroup.POST("/register", auth.RegisterHandler)
-
-		// Initialize JWT manager when both key paths are set
-		priv := os.Getenv("JWT_PRIVATE_KEY_PATH")
-		pub := os.Getenv("JWT_PUBLIC_KEY_PATH")
-		if priv != "" && pub != "" {
-			jwtMgr, err := auth.NewJWTManagerFromFiles(priv, pub, "vehicletracking", 15*time.Minute)
-			if err != nil {
-				s.logger.Warn("failed to initialize JWT manager", zap.Error(err))
-				authGroup.POST("/login", func(c *gin.Context) { c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()}) })
-				authGroup.POST("/refresh", func(c *gin.Context) { c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()}) })
-				authGroup.POST("/logout", func(c *gin.Context) { c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()}) })
-				return
-			}
-			authGroup.POST("/login", auth.LoginHandler(jwtMgr))
-			authGroup.POST("/refresh", auth.RefreshHandler(jwtMgr))
-			authGroup.POST("/logout", auth.LogoutHandler())
+		authGroup.POST("/register", auth.RegisterHandler(emails))
+		authGroup.POST("/verify-email", auth.VerifyEmailHandler())
+		authGroup.POST("/password/forgot", auth.ForgotPasswordHandler(emails))
+
+		if jwtErr != nil {
+			authGroup.POST("/login", unavailable)
+			authGroup.POST("/refresh", unavailable)
+			authGroup.POST("/logout", unavailable)
+			authGroup.POST("/password/reset", unavailable)
 		} else {
-			// Keys not provided
-			authGroup.POST("/login", func(c *gin.Context) {
-				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "JWT not configured: set JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH"})
-			})
-			authGroup.POST("/refresh", func(c *gin.Context) {
-				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "JWT not configured: set JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH"})
-			})
-			authGroup.POST("/logout", func(c *gin.Context) {
-				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "JWT not configured: set JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH"})
-			})
+			authGroup.POST("/login", auth.LoginHandler(jwtMgr, throttle, s.logger))
+			authGroup.POST("/refresh", auth.RefreshHandler(jwtMgr, s.logger))
+			authGroup.POST("/logout", auth.LogoutHandler(jwtMgr, denylist))
+			authGroup.POST("/password/reset", auth.ResetPasswordHandler(jwtMgr, denylist))
+		}
+
+		// Account self-service for the authenticated user
+		me := s.router.Group("/auth/me", preAuth, userAuth, limiter)
+		{
+			me.GET("", auth.MeHandler())
+			me.PATCH("", auth.UpdateMeHandler())
+			me.DELETE("", auth.DeleteMeHandler(jwtMgr, denylist, s.logger))
+			me.POST("/password", auth.ChangePasswordHandler(jwtMgr, denylist))
+			me.POST("/verify-email", auth.RequestVerificationHandler(emails))
+			me.GET("/sessions", auth.SessionsHandler())
+			me.DELETE("/sessions", auth.RevokeAllSessionsHandler(jwtMgr, denylist))
+			me.DELETE("/sessions/:id", auth.RevokeSessionHandler())
 		}
 	}
 
-	limiter := middleware.RateLimiterMiddleware(r.RDB(), 60, time.Minute)
+	fleet := handlers.NewFleetHandler(s.logger, buses)
+	geofences := handlers.NewGeofenceHandler(s.logger, r)
+	devices := handlers.NewDevicesHandler(s.logger, jwtMgr, denylist, s.config.Devices.TokenTTL)
+	users := handlers.NewUsersHandler(s.logger, jwtMgr, denylist)
+	dlq := handlers.NewDLQHandler(r, s.logger)
+	partitions := handlers.NewPartitionsHandler(s.logger)
+	gtfsImport := handlers.NewGTFSHandler(s.logger, buses)
 
 	// --- API Routes ---
-	api := s.router.Group("/api/v1")
-	api.Use(limiter)
+	// Routes are grouped by the permission they require; see auth/rbac.go for
+	// which roles hold which permissions.
+	api := s.router.Group("/api/v1", limiter)
 	{
 		api.GET("/ping", apiHandler.Ping)
 		api.GET("/version", apiHandler.Version)
-		api.POST("/locations", locations.Post)
+	}
+
+	authed := s.router.Group("/api/v1", preAuth, userAuth, limiter)
+
+	vehiclesRead := authed.Group("", middleware.RequirePermission(auth.PermVehiclesRead))
+	{
+		vehiclesRead.GET("/vehicles/nearby", vehicles.Nearby)
+		vehiclesRead.GET("/vehicles/:id/positions", vehicles.Positions)
+		vehiclesRead.GET("/vehicles/:id/eta", etas.VehicleETA)
+		vehiclesRead.GET("/stops/:id/arrivals", etas.StopArrivals)
+	}
+
+	fleetRead := authed.Group("", middleware.RequirePermission(auth.PermFleetRead))
+	{
+		fleetRead.GET("/routes", fleet.ListRoutes)
+		fleetRead.GET("/routes/:id", fleet.GetRoute)
+		fleetRead.GET("/routes/:id/stops", fleet.ListRouteStops)
+		fleetRead.GET("/stops", fleet.ListStops)
+		fleetRead.GET("/stops/:id", fleet.GetStop)
+		fleetRead.GET("/buses", fleet.ListBuses)
+		fleetRead.GET("/buses/:id", fleet.GetBus)
+	}
+
+	fleetWrite := authed.Group("", middleware.RequirePermission(auth.PermFleetWrite))
+	{
+		fleetWrite.POST("/routes", fleet.CreateRoute)
+		fleetWrite.PUT("/routes/:id", fleet.UpdateRoute)
+		fleetWrite.DELETE("/routes/:id", fleet.DeleteRoute)
+		fleetWrite.PUT("/routes/:id/stops/order", fleet.ReorderRouteStops)
+
+		fleetWrite.POST("/stops", fleet.CreateStop)
+		fleetWrite.PUT("/stops/:id", fleet.UpdateStop)
+		fleetWrite.DELETE("/stops/:id", fleet.DeleteStop)
+
+		fleetWrite.POST("/buses", fleet.CreateBus)
+		fleetWrite.PUT("/buses/:id", fleet.UpdateBus)
+		fleetWrite.DELETE("/buses/:id", fleet.DeleteBus)
+	}
+
+	geofencesRead := authed.Group("/geofences", middleware.RequirePermission(auth.PermVehiclesReadAll))
+	{
+		geofencesRead.GET("", geofences.ListGeofences)
+		geofencesRead.GET("/:id", geofences.GetGeofence)
+		geofencesRead.GET("/:id/events", geofences.ListGeofenceEvents)
+	}
+	geofencesWrite := authed.Group("/geofences", middleware.RequirePermission(auth.PermFleetWrite))
+	{
+		geofencesWrite.POST("", geofences.CreateGeofence)
+		geofencesWrite.PUT("/:id", geofences.UpdateGeofence)
+		geofencesWrite.DELETE("/:id", geofences.DeleteGeofence)
+	}
+
+	deviceTokens := authed.Group("/buses/:id/token", middleware.RequirePermission(auth.PermDevicesManage))
+	{
+		deviceTokens.POST("", devices.IssueToken)
+		deviceTokens.DELETE("", devices.RevokeTokens)
+	}
+
+	// --- Admin Routes ---
+	admin := authed.Group("/admin")
+	ops := admin.Group("", middleware.RequirePermission(auth.PermOpsManage))
+	{
+		ops.GET("/dlq", dlq.List)
+		ops.DELETE("/dlq", dlq.Purge)
+		ops.POST("/dlq/:id/replay", dlq.Replay)
+		ops.DELETE("/dlq/:id", dlq.Delete)
+		ops.GET("/partitions", partitions.List)
+	}
+	usersAdmin := admin.Group("/users", middleware.RequirePermission(auth.PermUsersManage))
+	{
+		usersAdmin.PUT("/:id/role", users.SetRole)
+		usersAdmin.POST("/:id/revoke-tokens", users.RevokeTokens)
+	}
+	admin.POST("/gtfs", middleware.RequirePermission(auth.PermFleetWrite), gtfsImport.Import)
+
+	// --- Ingest Routes ---
+	ingest := s.router.Group("/api/v1", deviceAuth, limiter)
+	{
+		ingest.POST("/locations", locations.Post)
+		// Gin parses ":batch" as a wildcard, so match the custom method on its value.
+		ingest.POST("/locations:method", func(c *gin.Context) {
+			if c.Param("method") != ":batch" {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			locations.PostBatch(c)
+		})
+	}
+
+	// --- GTFS-Realtime Routes ---
+	// Public, like the GTFS static feed they refer to.
+	gtfsRT := handlers.NewGTFSRTHandler(s.logger, gtfsrt.NewBuilder(r, s.config.Vehicles.StaleAfter, s.config.GTFSRT.CacheTTL))
+	rt := s.router.Group("/gtfs-rt", limiter)
+	{
+		rt.GET("/vehicle-positions", gtfsRT.VehiclePositions)
+		rt.GET("/trip-updates", gtfsRT.TripUpdates)
 	}
 
 	// WebSocket endpoint
 	s.router.GET("/ws", func(c *gin.Context) {
 		broker.ServeWS(c.Writer, c.Request)
 	})
+	// Single-use ticket for browsers that cannot send headers on the handshake
+	s.router.POST("/ws/ticket", preAuth, userAuth, func(c *gin.Context) {
+		claims := c.MustGet("claims").(*auth.Claims)
+		ticket, err := broker.IssueTicket(c.Request.Context(), claims)
+		if err != nil {
+			s.logger.Error("issue ws ticket failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ticket issue failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_in": int(ws.TicketTTL.Seconds())})
+	})
+}
+
+func rateLimitPolicies(cfg []config.RateLimitPolicy) []middleware.RateLimitPolicy {
+	policies := make([]middleware.RateLimitPolicy, len(cfg))
+	for i, p := range cfg {
+		policies[i] = middleware.RateLimitPolicy(p)
+	}
+	return policies
+}
+
+// newJWTManager loads the signing keys from JWT_KEYS_DIR or, failing that,
+// the RSA key pair named by JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH.
+func newJWTManager() (*auth.JWTManager, error) {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return auth.NewJWTManagerFromDir(dir, "vehicletracking", 15*time.Minute)
+	}
+	priv := os.Getenv("JWT_PRIVATE_KEY_PATH")
+	pub := os.Getenv("JWT_PUBLIC_KEY_PATH")
+	if priv == "" || pub == "" {
+		return nil, errors.New("JWT not configured: set JWT_KEYS_DIR, or JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH")
+	}
+	return auth.NewJWTManagerFromFiles(priv, pub, "vehicletracking", 15*time.Minute)
 }
 
 // Start starts the HTTP server
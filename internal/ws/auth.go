@@ -0,0 +1,153 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/auth"
+)
+
+const (
+	// TicketTTL is how long a ticket from IssueTicket can be redeemed on /ws.
+	TicketTTL = 30 * time.Second
+
+	// bearerProtocol is the Sec-WebSocket-Protocol marker for token auth:
+	// browsers pass ["bearer", "<jwt>"] and the server selects "bearer".
+	bearerProtocol = "bearer"
+)
+
+// identity is the authenticated principal behind a websocket connection.
+type identity struct {
+	UserID    string    `json:"uid"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+func identityFromClaims(claims *auth.Claims) (*identity, error) {
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	return &identity{UserID: claims.UserID, Role: claims.Role, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+// IssueTicket stores a single-use ticket for the given claims. Browsers that
+// cannot set headers on a websocket handshake pass it as /ws?ticket=<ticket>.
+// The socket still closes when the original access token expires.
+func (b *Broker) IssueTicket(ctx context.Context, claims *auth.Claims) (string, error) {
+	id, err := identityFromClaims(claims)
+	if err != nil {
+		return "", err
+	}
+	ticket, err := auth.GenerateRandom(32)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(id)
+	if err != nil {
+		return "", err
+	}
+	if err := b.redis.RDB().Set(ctx, "ws:ticket:"+ticket, payload, TicketTTL).Err(); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// authenticate resolves the caller from, in order, a ticket query parameter,
+// the Authorization header, or the Sec-WebSocket-Protocol header.
+func (b *Broker) authenticate(r *http.Request) (*identity, error) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		payload, err := b.redis.RDB().GetDel(r.Context(), "ws:ticket:"+ticket).Bytes()
+		if err != nil {
+			return nil, errors.New("invalid ticket")
+		}
+		var id identity
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return nil, errors.New("invalid ticket")
+		}
+		if time.Now().After(id.ExpiresAt) {
+			return nil, errors.New("token expired")
+		}
+		return &id, nil
+	}
+
+	token := bearerFromHeader(r.Header.Get("Authorization"))
+	if token == "" {
+		token = bearerFromProtocols(websocketProtocols(r))
+	}
+	if token == "" {
+		return nil, errors.New("missing credentials")
+	}
+	return b.validateToken(token)
+}
+
+func (b *Broker) validateToken(token string) (*identity, error) {
+	claims, err := b.jwt.ValidateToken(token)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Role == auth.RoleDevice {
+		return nil, errors.New("device tokens cannot subscribe")
+	}
+	if revoked, err := b.denylist.IsRevoked(context.Background(), claims); err != nil || revoked {
+		return nil, errors.New("invalid token")
+	}
+	return identityFromClaims(claims)
+}
+
+func bearerFromHeader(h string) string {
+	parts := strings.SplitN(h, " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+func bearerFromProtocols(protocols []string) string {
+	for i, p := range protocols {
+		if p == bearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var out []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// originChecker builds an upgrader CheckOrigin from an allowlist. An empty
+// list only accepts same-origin requests, "*" accepts any origin.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	set := make(map[string]bool, len(allowed))
+	for _, o := range allowed {
+		if o == "*" {
+			return func(r *http.Request) bool { return true }
+		}
+		set[strings.TrimRight(strings.ToLower(o), "/")] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Non-browser clients do not send Origin.
+			return true
+		}
+		if set[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
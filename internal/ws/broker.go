@@ -2,17 +2,35 @@ package ws
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/auth"
 	redisclient "github.com/SuperAwesomeTempName/VehicleTrackingBackend/internal/redis"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	pongWait   = 60 * time.Second
+	pingPeriod = 54 * time.Second
+	// maxMessageSize caps client control frames; large enough for a few hundred IDs.
+	maxMessageSize = 16 * 1024
+
+	// closeTokenExpired is sent when the access token lapses without a
+	// re-authentication frame (4000-4999 are reserved for applications).
+	closeTokenExpired = 4001
+)
+
 type Client struct {
 	conn *websocket.Conn
 	send chan []byte
+	subs *subscriptions
+	// id is only touched by the read pump; expiry changes reach the write
+	// pump through reauth.
+	id     *identity
+	reauth chan time.Time
 }
 
 type Broker struct {
@@ -20,15 +38,26 @@ type Broker struct {
 	register   chan *Client
 	unregister chan *Client
 	redis      *redisclient.Client
+	jwt        *auth.JWTManager
+	denylist   *auth.Denylist
+	upgrader   websocket.Upgrader
 	mu         sync.Mutex
 }
 
-func NewBroker(r *redisclient.Client) *Broker {
+// NewBroker fans vehicle:* and events:* messages out to websocket clients.
+// With a nil jwtMgr every connection is refused.
+func NewBroker(r *redisclient.Client, jwtMgr *auth.JWTManager, denylist *auth.Denylist, allowedOrigins []string) *Broker {
 	b := &Broker{
 		clients:    make(map[*Client]struct{}),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		redis:      r,
+		jwt:        jwtMgr,
+		denylist:   denylist,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  originChecker(allowedOrigins),
+			Subprotocols: []string{bearerProtocol},
+		},
 	}
 	go b.run()
 	go b.subscribeRedis(context.Background())
@@ -55,17 +84,22 @@ func (b *Broker) run() {
 }
 
 func (b *Broker) subscribeRedis(ctx context.Context) {
-	sub := b.redis.RDB().PSubscribe(ctx, "vehicle:*")
+	sub := b.redis.RDB().PSubscribe(ctx, "vehicle:*", "events:*")
 	ch := sub.Channel()
 	for msg := range ch {
-		b.broadcast([]byte(msg.Payload))
+		b.broadcast(msg.Channel, []byte(msg.Payload))
 	}
 }
 
-func (b *Broker) broadcast(msg []byte) {
+// broadcast forwards a vehicle event to every client whose subscriptions match it.
+func (b *Broker) broadcast(channel string, msg []byte) {
+	ev := parseEvent(channel, msg)
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	for c := range b.clients {
+		if !c.subs.matches(ev) {
+			continue
+		}
 		select {
 		case c.send <- msg:
 		default:
@@ -75,36 +109,118 @@ func (b *Broker) broadcast(msg []byte) {
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true }, // update for production with origin checks
+// reply queues a control frame for a single client if it is still registered.
+func (b *Broker) reply(c *Client, m *ServerMessage) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+	}
 }
 
+// handleClientMessage applies a subscribe/unsubscribe frame and acknowledges
+// it with the resulting subscription set, or extends the connection's lifetime
+// on an auth frame carrying a fresh access token for the same user.
+func (b *Broker) handleClientMessage(c *Client, data []byte) {
+	var m ClientMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		b.reply(c, &ServerMessage{Type: "error", Error: "invalid message"})
+		return
+	}
+	if m.Action == "auth" {
+		id, err := b.validateToken(m.Token)
+		if err != nil || id.UserID != c.id.UserID {
+			b.reply(c, &ServerMessage{Type: "error", Error: "invalid token"})
+			return
+		}
+		c.id = id
+		fleet := auth.HasPermission(id.Role, auth.PermVehiclesReadAll)
+		c.subs.setFleet(fleet)
+		if !fleet {
+			_ = c.subs.apply(&ClientMessage{Action: "unsubscribe", All: true}, false)
+		}
+		select {
+		case <-c.reauth:
+		default:
+		}
+		c.reauth <- id.ExpiresAt
+		b.reply(c, &ServerMessage{Type: "authenticated", ExpiresAt: id.ExpiresAt.Unix()})
+		return
+	}
+	if err := c.subs.apply(&m, auth.HasPermission(c.id.Role, auth.PermVehiclesReadAll)); err != nil {
+		b.reply(c, &ServerMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	b.reply(c, &ServerMessage{Type: m.Action + "d", Subscriptions: c.subs.view()})
+}
+
+// ServeWS authenticates the request and upgrades it to a websocket. The
+// origin allowlist is enforced by the upgrader.
 func (b *Broker) ServeWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if b.jwt == nil {
+		http.Error(w, "JWT not configured", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := b.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
-	client := &Client{conn: conn, send: make(chan []byte, 256)}
+	client := &Client{
+		conn:   conn,
+		send:   make(chan []byte, 256),
+		subs:   newSubscriptions(),
+		id:     id,
+		reauth: make(chan time.Time, 1),
+	}
+	client.subs.setFleet(auth.HasPermission(id.Role, auth.PermVehiclesReadAll))
 	b.register <- client
 
-	// read pump (we can ignore reads or handle subscribe messages)
+	// read pump: handles subscribe/unsubscribe control frames
 	go func() {
 		defer func() { b.unregister <- client }()
-		client.conn.SetReadLimit(512)
-		client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		client.conn.SetReadLimit(maxMessageSize)
+		client.conn.SetReadDeadline(time.Now().Add(pongWait))
+		client.conn.SetPongHandler(func(string) error {
+			return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
 		for {
-			if _, _, err := client.conn.NextReader(); err != nil {
+			mt, data, err := client.conn.ReadMessage()
+			if err != nil {
 				break
 			}
+			client.conn.SetReadDeadline(time.Now().Add(pongWait))
+			if mt == websocket.TextMessage {
+				b.handleClientMessage(client, data)
+			}
 		}
 	}()
 
 	// write pump
 	go func() {
-		ticker := time.NewTicker(54 * time.Second)
-		defer func() { ticker.Stop(); client.conn.Close() }()
+		ticker := time.NewTicker(pingPeriod)
+		expiry := time.NewTimer(time.Until(id.ExpiresAt))
+		defer func() { ticker.Stop(); expiry.Stop(); client.conn.Close() }()
 		for {
 			select {
+			case exp := <-client.reauth:
+				expiry.Reset(time.Until(exp))
+			case <-expiry.C:
+				client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeTokenExpired, "token expired"))
+				return
 			case msg, ok := <-client.send:
 				client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 				if !ok {
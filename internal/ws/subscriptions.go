@@ -0,0 +1,194 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// maxTopicsPerClient bounds how many bus and route IDs one socket may follow.
+const maxTopicsPerClient = 1000
+
+// ClientMessage is a control frame sent by a websocket client.
+//
+//	{"action":"subscribe","busIds":["<id>"],"routeIds":["<id>"],"bbox":[minLon,minLat,maxLon,maxLat]}
+//	{"action":"subscribe","all":true}
+//	{"action":"unsubscribe","busIds":["<id>"]}
+//	{"action":"auth","token":"<jwt>"}
+//
+// Unsubscribing with any bbox clears the current bounding box. Only fleet
+// roles may subscribe with all.
+type ClientMessage struct {
+	Action   string   `json:"action"`
+	Token    string   `json:"token,omitempty"`
+	All      bool     `json:"all,omitempty"`
+	BusIDs   []string `json:"busIds,omitempty"`
+	RouteIDs []string `json:"routeIds,omitempty"`
+	BBox     *BBox    `json:"bbox,omitempty"`
+}
+
+// BBox is [minLon, minLat, maxLon, maxLat], the GeoJSON bbox order.
+type BBox [4]float64
+
+func (b *BBox) valid() bool {
+	return b[0] >= -180 && b[2] <= 180 && b[1] >= -90 && b[3] <= 90 && b[0] <= b[2] && b[1] <= b[3]
+}
+
+func (b *BBox) contains(lat, lon float64) bool {
+	return lon >= b[0] && lon <= b[2] && lat >= b[1] && lat <= b[3]
+}
+
+// ServerMessage is a control frame sent back to a websocket client. Vehicle,
+// stop and geofence events are forwarded as published and never use this envelope.
+type ServerMessage struct {
+	Type          string            `json:"type"`
+	Error         string            `json:"error,omitempty"`
+	ExpiresAt     int64             `json:"expiresAt,omitempty"`
+	Subscriptions *SubscriptionView `json:"subscriptions,omitempty"`
+}
+
+type SubscriptionView struct {
+	All      bool     `json:"all"`
+	BusIDs   []string `json:"busIds"`
+	RouteIDs []string `json:"routeIds"`
+	BBox     *BBox    `json:"bbox,omitempty"`
+}
+
+// fleetOnlyChannels carry events only delivered to clients whose role has
+// auth.PermVehiclesReadAll.
+var fleetOnlyChannels = map[string]bool{"events:geofences": true}
+
+// subscriptions holds what a single client asked to receive. A new client
+// has no subscriptions and receives no vehicle events.
+type subscriptions struct {
+	mu     sync.RWMutex
+	all    bool
+	fleet  bool
+	buses  map[string]struct{}
+	routes map[string]struct{}
+	bbox   *BBox
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		buses:  make(map[string]struct{}),
+		routes: make(map[string]struct{}),
+	}
+}
+
+// apply updates the subscription set from a client message. fleet reports
+// whether the client's role has auth.PermVehiclesReadAll.
+func (s *subscriptions) apply(m *ClientMessage, fleet bool) error {
+	if m.BBox != nil && m.Action == "subscribe" && !m.BBox.valid() {
+		return errors.New("invalid bbox")
+	}
+	if m.All && m.Action == "subscribe" && !fleet {
+		return errors.New("forbidden: all requires the vehicles:read_all permission")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Action {
+	case "subscribe":
+		if len(s.buses)+len(s.routes)+len(m.BusIDs)+len(m.RouteIDs) > maxTopicsPerClient {
+			return errors.New("too many subscriptions")
+		}
+		if m.All {
+			s.all = true
+		}
+		for _, id := range m.BusIDs {
+			s.buses[id] = struct{}{}
+		}
+		for _, id := range m.RouteIDs {
+			s.routes[id] = struct{}{}
+		}
+		if m.BBox != nil {
+			bbox := *m.BBox
+			s.bbox = &bbox
+		}
+	case "unsubscribe":
+		if m.All {
+			s.all = false
+		}
+		for _, id := range m.BusIDs {
+			delete(s.buses, id)
+		}
+		for _, id := range m.RouteIDs {
+			delete(s.routes, id)
+		}
+		if m.BBox != nil {
+			s.bbox = nil
+		}
+	default:
+		return errors.New("unknown action")
+	}
+	return nil
+}
+
+// setFleet records whether the client's role has auth.PermVehiclesReadAll.
+func (s *subscriptions) setFleet(fleet bool) {
+	s.mu.Lock()
+	s.fleet = fleet
+	s.mu.Unlock()
+}
+
+func (s *subscriptions) view() *SubscriptionView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v := &SubscriptionView{All: s.all, BusIDs: []string{}, RouteIDs: []string{}}
+	for id := range s.buses {
+		v.BusIDs = append(v.BusIDs, id)
+	}
+	for id := range s.routes {
+		v.RouteIDs = append(v.RouteIDs, id)
+	}
+	if s.bbox != nil {
+		bbox := *s.bbox
+		v.BBox = &bbox
+	}
+	return v
+}
+
+func (s *subscriptions) matches(ev *event) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if ev.fleetOnly && !s.fleet {
+		return false
+	}
+	if s.all {
+		return true
+	}
+	if _, ok := s.buses[ev.BusID]; ok {
+		return true
+	}
+	if ev.RouteID != "" {
+		if _, ok := s.routes[ev.RouteID]; ok {
+			return true
+		}
+	}
+	return s.bbox != nil && ev.Lat != nil && ev.Lon != nil && s.bbox.contains(*ev.Lat, *ev.Lon)
+}
+
+// event is the subset of a published vehicle message used for filtering.
+type event struct {
+	BusID   string   `json:"busId"`
+	RouteID string   `json:"routeId"`
+	Lat     *float64 `json:"lat"`
+	Lon     *float64 `json:"lon"`
+
+	fleetOnly bool
+}
+
+// parseEvent decodes a payload published on vehicle:<busId> or events:*. For
+// vehicle channels the bus ID falls back to the channel suffix when the
+// payload does not carry one.
+func parseEvent(channel string, payload []byte) *event {
+	ev := &event{}
+	_ = json.Unmarshal(payload, ev)
+	if ev.BusID == "" && strings.HasPrefix(channel, "vehicle:") {
+		ev.BusID = strings.TrimPrefix(channel, "vehicle:")
+	}
+	ev.fleetOnly = fleetOnlyChannels[channel]
+	return ev
+}
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'user';
+UPDATE users SET role = 'user' WHERE role = 'rider';
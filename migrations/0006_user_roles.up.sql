@@ -0,0 +1,6 @@
+-- 'user' was the only role before RBAC; it maps to rider.
+UPDATE users SET role = 'rider' WHERE role = 'user';
+
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'rider';
+ALTER TABLE users ADD CONSTRAINT users_role_check
+  CHECK (role IN ('admin', 'dispatcher', 'driver', 'rider'));
@@ -0,0 +1,12 @@
+-- Every login starts a family; rotations stay in it. Existing rows each become
+-- their own family.
+ALTER TABLE refresh_tokens
+  ADD COLUMN IF NOT EXISTS family_id uuid NOT NULL DEFAULT gen_random_uuid(),
+  ADD COLUMN IF NOT EXISTS revoked_at timestamptz,
+  ADD COLUMN IF NOT EXISTS revoked_reason text;
+
+-- Tokens revoked before families existed must not trigger reuse detection.
+UPDATE refresh_tokens SET revoked_reason = 'legacy' WHERE revoked AND revoked_reason IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_hash ON refresh_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family_id);
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS stop_times;
+DROP TABLE IF EXISTS trips;
+DROP TABLE IF EXISTS shapes;
+DROP TABLE IF EXISTS calendar;
+DROP TABLE IF EXISTS agencies;
+
+DROP INDEX IF EXISTS idx_stops_route_gtfs_id;
+ALTER TABLE stops DROP COLUMN IF EXISTS gtfs_id;
+DROP INDEX IF EXISTS idx_routes_gtfs_id;
+ALTER TABLE routes DROP COLUMN IF EXISTS gtfs_id;
@@ -0,0 +1,62 @@
+-- GTFS static import (cmd/gtfsimport, POST /api/v1/admin/gtfs). Rows created
+-- by the importer carry the feed's id in gtfs_id; rows without one were
+-- created by hand and are never touched by an import.
+
+CREATE TABLE IF NOT EXISTS agencies (
+  gtfs_id text PRIMARY KEY,
+  name text NOT NULL,
+  url text NOT NULL,
+  timezone text NOT NULL,
+  lang text,
+  phone text
+);
+
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS gtfs_id text;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_routes_gtfs_id ON routes (gtfs_id);
+
+-- GTFS stops are shared between routes, stops here belong to one route; an
+-- imported stop gets one row per route serving it.
+ALTER TABLE stops ADD COLUMN IF NOT EXISTS gtfs_id text;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stops_route_gtfs_id ON stops (route_id, gtfs_id);
+
+CREATE TABLE IF NOT EXISTS calendar (
+  service_id text PRIMARY KEY,
+  monday boolean NOT NULL,
+  tuesday boolean NOT NULL,
+  wednesday boolean NOT NULL,
+  thursday boolean NOT NULL,
+  friday boolean NOT NULL,
+  saturday boolean NOT NULL,
+  sunday boolean NOT NULL,
+  start_date date NOT NULL,
+  end_date date NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS shapes (
+  gtfs_id text PRIMARY KEY,
+  geom geometry(LineString,4326) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS trips (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  gtfs_id text NOT NULL UNIQUE,
+  route_id uuid NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+  service_id text NOT NULL,
+  headsign text,
+  direction_id smallint,
+  block_id text,
+  shape_id text
+);
+CREATE INDEX IF NOT EXISTS idx_trips_route ON trips (route_id);
+
+-- Times are seconds after midnight of the service day and may exceed 24h for
+-- trips running past midnight, as in GTFS.
+CREATE TABLE IF NOT EXISTS stop_times (
+  trip_id uuid NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+  stop_sequence int NOT NULL,
+  stop_id uuid NOT NULL REFERENCES stops(id) ON DELETE CASCADE,
+  arrival_secs int,
+  departure_secs int,
+  PRIMARY KEY (trip_id, stop_sequence)
+);
+CREATE INDEX IF NOT EXISTS idx_stop_times_stop ON stop_times (stop_id);
@@ -0,0 +1,15 @@
+-- Arrivals at and departures from route stops, derived from fixes by the
+-- worker. dwell_seconds is set on departures only.
+CREATE TABLE IF NOT EXISTS stop_events (
+  id bigserial PRIMARY KEY,
+  bus_id uuid NOT NULL REFERENCES buses(id) ON DELETE CASCADE,
+  route_id uuid REFERENCES routes(id) ON DELETE SET NULL,
+  stop_id uuid NOT NULL REFERENCES stops(id) ON DELETE CASCADE,
+  event text NOT NULL CHECK (event IN ('arrived', 'departed')),
+  ts timestamptz NOT NULL,
+  dwell_seconds int,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_stop_events_stop_ts ON stop_events (stop_id, ts DESC);
+CREATE INDEX IF NOT EXISTS idx_stop_events_bus_ts ON stop_events (bus_id, ts DESC);
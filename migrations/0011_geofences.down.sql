@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS geofence_events;
+DROP TABLE IF EXISTS geofences;
@@ -0,0 +1,39 @@
+-- Geofences evaluated by the worker against every stored fix. A polygon
+-- fence stores its area in geom; a circle stores its center point there and
+-- its radius in radius_m.
+CREATE TABLE IF NOT EXISTS geofences (
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  name text NOT NULL,
+  kind text NOT NULL CHECK (kind IN ('polygon', 'circle')),
+  geom geometry(Geometry,4326) NOT NULL,
+  radius_m double precision,
+  -- dwell_seconds, when set, raises a dwell event once a bus has been inside
+  -- that long.
+  dwell_seconds int CHECK (dwell_seconds > 0),
+  active boolean NOT NULL DEFAULT true,
+  metadata jsonb DEFAULT '{}'::jsonb,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now(),
+  CHECK (
+    (kind = 'circle' AND GeometryType(geom) = 'POINT' AND radius_m > 0)
+    OR (kind = 'polygon' AND GeometryType(geom) = 'POLYGON' AND radius_m IS NULL AND ST_IsValid(geom))
+  )
+);
+
+CREATE INDEX IF NOT EXISTS idx_geofences_geom ON geofences USING gist (geom);
+
+CREATE TABLE IF NOT EXISTS geofence_events (
+  id bigserial PRIMARY KEY,
+  geofence_id uuid NOT NULL REFERENCES geofences(id) ON DELETE CASCADE,
+  bus_id uuid NOT NULL REFERENCES buses(id) ON DELETE CASCADE,
+  event text NOT NULL CHECK (event IN ('enter', 'exit', 'dwell')),
+  ts timestamptz NOT NULL,
+  lat double precision NOT NULL,
+  lon double precision NOT NULL,
+  -- dwell_seconds is the time inside the fence, set on exit and dwell events.
+  dwell_seconds int,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_geofence_events_geofence_ts ON geofence_events (geofence_id, ts DESC);
+CREATE INDEX IF NOT EXISTS idx_geofence_events_bus_ts ON geofence_events (bus_id, ts DESC);
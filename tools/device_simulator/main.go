@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"flag"
+	"log"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,25 +22,60 @@ type Loc struct {
 	Heading   float64 `json:"heading"`
 }
 
-func simulate(i int, wg *sync.WaitGroup, endpoint string) {
+type device struct {
+	busID string
+	token string
+}
+
+func simulate(i int, d device, wg *sync.WaitGroup, endpoint string) {
 	defer wg.Done()
-	busid := fmt.Sprintf("bus-%d", i)
 	lat, lon := 19.0+float64(i%10)*0.001, 72.0+float64(i%10)*0.001
 	for {
-		loc := Loc{BusID: busid, Latitude: lat, Longitude: lon, Timestamp: time.Now().Unix(), SpeedKph: 30.0, Heading: 0.0}
+		loc := Loc{BusID: d.busID, Latitude: lat, Longitude: lon, Timestamp: time.Now().Unix(), SpeedKph: 30.0, Heading: 0.0}
 		b, _ := json.Marshal(loc)
-		http.Post(endpoint, "application/json", bytes.NewReader(b))
+		req, _ := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+d.token)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
 		time.Sleep(5 * time.Second)
 	}
 }
 
+// loadDevices reads "<busId> <device-token>" lines, e.g. the bus ids of
+// registered buses and tokens from POST /api/v1/buses/:id/token.
+func loadDevices(path string) ([]device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []device
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		out = append(out, device{busID: fields[0], token: fields[1]})
+	}
+	return out, sc.Err()
+}
+
 func main() {
-	num := 100
-	endpoint := "http://localhost:8080/api/locations"
+	tokens := flag.String("tokens", "devices.txt", "file of \"<busId> <device-token>\" lines")
+	endpoint := flag.String("endpoint", "http://localhost:8080/api/v1/locations", "ingest endpoint")
+	flag.Parse()
+
+	devices, err := loadDevices(*tokens)
+	if err != nil {
+		log.Fatalf("load devices: %v", err)
+	}
 	var wg sync.WaitGroup
-	for i := 0; i < num; i++ {
+	for i, d := range devices {
 		wg.Add(1)
-		go simulate(i, &wg, endpoint)
+		go simulate(i, d, &wg, *endpoint)
 	}
 	wg.Wait()
 }